@@ -0,0 +1,8 @@
+module github.com/mattn/go-xmpp
+
+go 1.24.0
+
+require (
+	golang.org/x/net v0.50.0
+	golang.org/x/text v0.34.0
+)
@@ -15,21 +15,22 @@ package xmpp
 import (
 	"bufio"
 	"bytes"
-	"crypto/md5"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
-	"encoding/base64"
 	"encoding/binary"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
-	"math/big"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -41,6 +42,7 @@ const (
 	NsSession = "urn:ietf:params:xml:ns:xmpp-session"
 	nsMUC     = "http://jabber.org/protocol/muc"
 	nsMUCUser = "http://jabber.org/protocol/muc#user"
+	nsCaps    = "http://jabber.org/protocol/caps"
 )
 
 var DefaultConfig tls.Config
@@ -55,26 +57,178 @@ func getCookie() Cookie {
 	return Cookie(binary.LittleEndian.Uint64(buf[:]))
 }
 
+// ErrConcurrentRecv is returned by Recv and Serve when another goroutine is
+// already reading from the stream.
+var ErrConcurrentRecv = errors.New("xmpp: Recv or Serve called while another read is in progress")
+
+// A Client may be read from by one goroutine at a time, with Recv or Serve,
+// and written to by any number of goroutines at once.  Writes are serialized
+// so that stanzas never interleave on the wire.
 type Client struct {
-	conn   net.Conn // connection to server
-	jid    string   // Jabber ID for our connection
-	domain string
-	p      *xml.Decoder
+	sendMu   sync.Mutex      // serializes writes; held while conn is replaced
+	connMu   sync.Mutex      // held while conn is replaced, so Close need not wait for writes
+	reading  int32           // set while Recv or Serve is running
+	inflight chan recvResult // read left running by a RecvContext that gave up
+	conn     net.Conn        // connection to server
+	jid      string          // Jabber ID for our connection
+	domain   string
+	p        *xml.Decoder
+	carbons  bool     // message carbons (XEP-0280) have been enabled
+	opts     Options  // options the client was created with
+	endpoint endpoint // endpoint the client is connected to
+
+	redirecting bool // a see-other-host redirect is replacing conn
+
+	iqMu sync.Mutex
+	iqs  map[string]*iqRequest // SendIQ calls waiting for a response, by id
+
+	done      chan struct{} // closed by Close
+	closeOnce sync.Once
+
+	sm      *smState // stream management (XEP-0198), once enabled
+	prev    *smState // stream management state to take over while logging in
+	resumed bool     // the stream resumed prev rather than starting afresh
+	unacked []string // stanzas of prev the server missed, for restore to send
+
+	// What a reconnection has to restore; see ReconnectingClient.
+	stateMu  sync.Mutex
+	mucs     map[string]bool // rooms joined with JoinMUC
+	presence *Presence       // last broadcast presence sent with SendPresence
 }
 
-func connect(host, user, passwd string) (net.Conn, error) {
-	addr := host
+// connect dials eps, or the endpoints for domain if eps is nil, in turn until one
+// of them yields a stream that satisfies o.TLSPolicy, and returns that stream's
+// features.  The client is left ready to authenticate.
+func (c *Client) connect(ctx context.Context, o *Options, domain string, eps []endpoint) (*streamFeatures, error) {
+	if eps == nil {
+		eps = o.endpoints(ctx, domain)
+	}
+	var err error
+	for _, e := range eps {
+		var f *streamFeatures
+		c.endpoint = e
+		if f, err = c.connectEndpoint(ctx, o, domain, e); err == nil {
+			return f, nil
+		}
+		if c.conn != nil {
+			c.conn.Close()
+			c.conn = nil
+		}
+		if isSeeOtherHost(err) || ctx.Err() != nil {
+			// the server is there, it just wants us elsewhere; or we are out of time.
+			break
+		}
+	}
+	return nil, err
+}
+
+// connectEndpoint dials e, performs the TLS handshake if e expects direct TLS,
+// starts the stream and negotiates STARTTLS if required.
+func (c *Client) connectEndpoint(ctx context.Context, o *Options, domain string, e endpoint) (*streamFeatures, error) {
+	dctx := ctx
+	if o.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		dctx, cancel = context.WithTimeout(ctx, o.DialTimeout)
+		defer cancel()
+	}
+	conn, err := dial(dctx, o.dialer(), e.addr)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+
+	done := c.withDeadline(ctx, o.TLSTimeout)
+	f, err := c.secureStream(o, domain, e)
+	return f, done(err)
+}
+
+// secureStream establishes the stream on the freshly dialed connection.
+func (c *Client) secureStream(o *Options, domain string, e endpoint) (*streamFeatures, error) {
+	if e.directTLS {
+		tc := o.tlsConfig(domain)
+		if len(tc.NextProtos) == 0 {
+			tc.NextProtos = []string{"xmpp-client"}
+		}
+		tlsconn := tls.Client(c.conn, tc)
+		if err := tlsconn.Handshake(); err != nil {
+			return nil, err
+		}
+		c.conn = tlsconn
+	}
+
+	// Declare intent to be a jabber client and gather stream features.
+	f, err := c.startStream(o, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	// If the server requires we STARTTLS, attempt to do so.
+	if f, err = c.startTlsIfRequired(f, o, domain); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
 
-	if strings.TrimSpace(host) == "" {
-		a := strings.SplitN(user, "@", 2)
-		if len(a) == 2 {
-			host = a[1]
+// withDeadline bounds the reads and writes on c.conn by ctx and by timeout, if
+// positive, until the returned function is called with the outcome of the
+// operation.  That function returns the outcome, or the context's error if
+// the operation failed because it ran out of time.
+func (c *Client) withDeadline(ctx context.Context, timeout time.Duration) func(error) error {
+	cancel := func() {}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	conn := c.conn
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			// Unblock whatever is waiting on the connection.
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
 		}
+	}()
+	return func(err error) error {
+		close(stop)
+		wg.Wait()
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			// The connection's deadline may pass a moment before the context notices.
+			if d, ok := ctx.Deadline(); ctx.Err() != nil || ok && !time.Now().Before(d) {
+				err = ctx.Err()
+				if err == nil {
+					err = context.DeadlineExceeded
+				}
+			}
+		}
+		cancel()
+		return err
 	}
-	a := strings.SplitN(host, ":", 2)
-	if len(a) == 1 {
-		host += ":5222"
+}
+
+// Dialer opens network connections.  *net.Dialer implements it, as do most
+// proxy dialers.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (o *Options) dialer() Dialer {
+	if o.Dialer != nil {
+		return o.Dialer
 	}
+	return new(net.Dialer)
+}
+
+// dial opens a TCP connection to addr with d, tunnelling through the HTTP proxy
+// named by $HTTP_PROXY if there is one.
+func dial(ctx context.Context, d Dialer, host string) (net.Conn, error) {
+	addr := host
 	proxy := os.Getenv("HTTP_PROXY")
 	if proxy == "" {
 		proxy = os.Getenv("http_proxy")
@@ -85,12 +239,16 @@ func connect(host, user, passwd string) (net.Conn, error) {
 			addr = url.Host
 		}
 	}
-	c, err := net.Dial("tcp", addr)
+	c, err := d.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
 
 	if proxy != "" {
+		if dl, ok := ctx.Deadline(); ok {
+			c.SetDeadline(dl)
+			defer c.SetDeadline(time.Time{})
+		}
 		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\n", host)
 		fmt.Fprintf(c, "Host: %s\r\n", host)
 		fmt.Fprintf(c, "\r\n")
@@ -98,9 +256,11 @@ func connect(host, user, passwd string) (net.Conn, error) {
 		req, _ := http.NewRequest("CONNECT", host, nil)
 		resp, err := http.ReadResponse(br, req)
 		if err != nil {
+			c.Close()
 			return nil, err
 		}
 		if resp.StatusCode != 200 {
+			c.Close()
 			f := strings.SplitN(resp.Status, " ", 2)
 			return nil, errors.New(f[1])
 		}
@@ -111,21 +271,54 @@ func connect(host, user, passwd string) (net.Conn, error) {
 // Options are used to specify additional options for new clients, such as a Resource.
 type Options struct {
 	// Host specifies what host to connect to, as either "hostname" or "hostname:port"
-	// If host is not specified, the  DNS SRV should be used to find the host from the domainpart of the JID.
+	// If host is not specified, the DNS SRV records of the domainpart of the JID are used to find the host,
+	// falling back to the domainpart itself.
 	// Default the port to 5222.
 	Host string
 
+	// Resolver is used to look up DNS SRV records when Host is not specified.
+	// If nil, net.DefaultResolver is used.
+	Resolver Resolver
+
+	// Dialer opens the TCP connection to the server.  If nil, a net.Dialer is used.
+	Dialer Dialer
+
+	// DialTimeout limits each attempt to connect to an endpoint.  Zero means no limit.
+	DialTimeout time.Duration
+
+	// TLSTimeout limits opening the stream on a connection: the TLS handshake and STARTTLS
+	// negotiation.  Zero means no limit.
+	TLSTimeout time.Duration
+
+	// AuthTimeout limits the SASL exchange.  Zero means no limit.
+	AuthTimeout time.Duration
+
+	// BindTimeout limits binding the resource and setting up the session once authenticated.
+	// Zero means no limit.
+	BindTimeout time.Duration
+
 	// User specifies what user to authenticate to the remote server.
 	User string
 
 	// Password supplies the password to use for authentication with the remote server.
 	Password string
 
+	// AuthzID is the authorization identity to request, if it differs from the identity that
+	// authenticates; most useful with SASL EXTERNAL when a certificate carries several JIDs.
+	AuthzID string
+
 	// Resource specifies an XMPP client resource, like "bot", instead of accepting one
-	// from the server.  Use "" to let the server generate one for your client.
+	// from the server.  Use "" to let the server generate one for your client.  Setting it
+	// turns off Bind 2 (XEP-0386), which cannot request a given resource, so that binding
+	// takes a round trip of its own after SASL2 login.
 	Resource string
 
-	// TLS Config
+	// Mechanisms lists the SASL mechanisms to use, most preferred first.  The first one that the
+	// server offers and that can be used on the connection is chosen.  If nil, DefaultMechanisms is used.
+	Mechanisms []Mechanism
+
+	// TLS Config.  If it carries client Certificates, SASL EXTERNAL (XEP-0178) is
+	// preferred over password based mechanisms.
 	TLSConfig *tls.Config
 
 	// InsecureAllowUnencryptedAuth permits authentication over a TCP connection that has not been promoted to
@@ -137,8 +330,15 @@ type Options struct {
 	// TCP connection should be used. (Can be combined with StartTLS to support STARTTLS-based servers.)
 	NoTLS bool
 
+	// TLSPolicy selects between direct TLS and STARTTLS endpoints.  See TLSPolicy.
+	TLSPolicy TLSPolicy
+
+	// MaxRedirects is the number of see-other-host stream errors that are followed in a row,
+	// both while connecting and once connected.  Zero means 5; a negative value disables redirects.
+	MaxRedirects int
+
 	// StartTLS directs go-xmpp to STARTTLS if the server supports it; go-xmpp will automatically STARTTLS
-	// if the server requires it regardless of this option.
+	// if the server requires it regardless of this option, unless TLSPolicy is TLSDisabled.
 	StartTLS bool
 
 	// Debug output
@@ -147,6 +347,44 @@ type Options struct {
 	// Use server sessions
 	Session bool
 
+	// IQTimeout limits how long SendIQ waits for a response when its context has no deadline.
+	// Zero means DefaultIQTimeout.
+	IQTimeout time.Duration
+
+	// UserAgentID identifies this installation of the client to servers that support SASL2 (XEP-0388).
+	// It should be a UUID that stays the same across restarts.
+	UserAgentID string
+
+	// TokenStore, if set together with UserAgentID, makes the client ask servers that support FAST
+	// (XEP-0484) for a token after logging in with the password, and log in with that token the
+	// next time.  Once a token is stored the Password may be left empty.
+	TokenStore TokenStore
+
+	// Carbons enables Message Carbons (XEP-0280), inline with Bind 2 (XEP-0386) when the server allows it.
+	Carbons bool
+
+	// StreamManagement enables Stream Management (XEP-0198) when the server supports it: stanzas
+	// are kept until the server acknowledges them, and a ReconnectingClient resumes the stream, or
+	// at least sends them again, after a disconnection.
+	StreamManagement bool
+
+	// KeepAliveInterval, if positive, makes the client write to the stream at this interval so that
+	// idle connections are not dropped by servers or middleboxes.
+	KeepAliveInterval time.Duration
+
+	// KeepAlivePing makes the keepalive send XMPP Pings (XEP-0199) to the server rather than
+	// whitespace.  The connection is closed, and Recv fails, when a ping goes unanswered.  Pings
+	// are answered by Recv, so it must be running.
+	KeepAlivePing bool
+
+	// KeepAliveTimeout is how long a keepalive ping may go unanswered.  Zero means KeepAliveInterval.
+	KeepAliveTimeout time.Duration
+
+	// StrictParsing makes Recv fail on a top-level element it does not know.  By default such an
+	// element is returned as a RawElement event, so that a server sending something new does not
+	// end the stream.
+	StrictParsing bool
+
 	// Presence Status
 	Status string
 
@@ -154,46 +392,260 @@ type Options struct {
 	StatusMessage string
 }
 
+// TLSPolicy controls which kinds of endpoints NewClient connects to, and in
+// which order.  Direct TLS endpoints (XEP-0368) expect a TLS handshake as soon
+// as the TCP connection is established; STARTTLS endpoints start in plain
+// text and are upgraded to TLS with STARTTLS.
+type TLSPolicy int
+
+const (
+	// DefaultTLSPolicy tries endpoints in the order given by DNS SRV.  If Host
+	// is set, it is treated as a direct TLS endpoint unless NoTLS is set.  TLS
+	// is required unless NoTLS is set.
+	DefaultTLSPolicy TLSPolicy = iota
+
+	// RequireTLS tries endpoints in the order given by DNS SRV, and refuses any
+	// endpoint on which TLS could not be established, even with NoTLS.
+	RequireTLS
+
+	// PreferDirectTLS tries all direct TLS endpoints before any STARTTLS
+	// endpoint.  TLS is required.
+	PreferDirectTLS
+
+	// StartTLSOnly only connects to STARTTLS endpoints.  TLS is required.
+	StartTLSOnly
+
+	// TLSDisabled only connects to STARTTLS endpoints and never negotiates
+	// STARTTLS, failing with ErrStartTLSRequired if the server insists on it.
+	// Authentication additionally requires InsecureAllowUnencryptedAuth.
+	TLSDisabled
+)
+
+var (
+	// ErrStartTLSRequired is returned when the server requires STARTTLS but
+	// the TLSPolicy is TLSDisabled.
+	ErrStartTLSRequired = errors.New("xmpp: server requires STARTTLS but TLS is disabled")
+
+	// ErrStartTLSUnavailable is returned when TLS is required but the server
+	// does not offer STARTTLS.
+	ErrStartTLSUnavailable = errors.New("xmpp: server does not offer STARTTLS")
+
+	// ErrStartTLSFailed is returned when the server answers <starttls/> with
+	// <failure/>.
+	ErrStartTLSFailed = errors.New("xmpp: server refused STARTTLS")
+)
+
+// endpoints returns the endpoints to try for domain, in order.
+func (o *Options) endpoints(ctx context.Context, domain string) []endpoint {
+	if strings.TrimSpace(o.Host) != "" {
+		direct := !o.NoTLS && o.TLSPolicy != StartTLSOnly && o.TLSPolicy != TLSDisabled
+		return []endpoint{hostEndpoint(o.Host, direct)}
+	}
+
+	all := lookupEndpoints(ctx, o.Resolver, domain)
+	var direct, starttls []endpoint
+	for _, e := range all {
+		if e.directTLS {
+			direct = append(direct, e)
+		} else {
+			starttls = append(starttls, e)
+		}
+	}
+	var eps []endpoint
+	switch {
+	case o.TLSPolicy == StartTLSOnly || o.TLSPolicy == TLSDisabled,
+		o.TLSPolicy == DefaultTLSPolicy && o.NoTLS:
+		eps = starttls
+	case o.TLSPolicy == PreferDirectTLS:
+		eps = append(direct, starttls...)
+	default:
+		eps = all
+	}
+	if len(eps) == 0 {
+		// RFC 6120 3.2.2: fall back to the domain itself on the default port.
+		eps = []endpoint{hostEndpoint(domain, false)}
+	}
+	return eps
+}
+
+// tlsRequired reports whether a connection must end up encrypted.
+func (o *Options) tlsRequired() bool {
+	switch o.TLSPolicy {
+	case DefaultTLSPolicy:
+		return !o.NoTLS
+	case TLSDisabled:
+		return false
+	}
+	return true
+}
+
+// tlsConfig returns a copy of the TLS configuration to use, with ServerName
+// defaulting to domain.
+func (o *Options) tlsConfig(domain string) *tls.Config {
+	var tc *tls.Config
+	if o.TLSConfig != nil {
+		tc = o.TLSConfig.Clone()
+	} else {
+		tc = DefaultConfig.Clone()
+	}
+	if tc.ServerName == "" {
+		tc.ServerName = domain
+	}
+	if o.TokenStore != nil && tc.ClientSessionCache == nil {
+		tc.ClientSessionCache = fastSessions
+	}
+	return tc
+}
+
 // NewClient establishes a new Client connection based on a set of Options.
 func (o Options) NewClient() (*Client, error) {
-	host := o.Host
-	c, err := connect(host, o.User, o.Password)
+	return o.NewClientContext(context.Background())
+}
+
+// NewClientContext is like NewClient, but gives up once ctx is done.  The
+// timeouts in Options apply as well.
+func (o Options) NewClientContext(ctx context.Context) (*Client, error) {
+	return o.newClient(ctx, nil)
+}
+
+// newClient connects and logs in, taking over the stream management state
+// prev if it is not nil.
+func (o Options) newClient(ctx context.Context, prev *smState) (*Client, error) {
+	user, err := parseUser(o.User)
 	if err != nil {
 		return nil, err
 	}
+	domain := user.asciiDomain()
 
 	client := new(Client)
-	if o.NoTLS {
-		client.conn = c
-	} else {
-		var tlsconn *tls.Conn
-		if o.TLSConfig != nil {
-			tlsconn = tls.Client(c, o.TLSConfig)
-		} else {
-			tlsconn = tls.Client(c, &DefaultConfig)
-		}
-		if err = tlsconn.Handshake(); err != nil {
-			return nil, err
+	client.domain = domain
+	client.opts = o
+	client.prev = prev
+	client.done = make(chan struct{})
+	var eps []endpoint
+	if prev != nil && prev.canResume() && prev.location != "" {
+		// Try the host the server asked us to resume at first.
+		eps = append([]endpoint{hostEndpoint(prev.location, prev.directTLS)}, o.endpoints(ctx, domain)...)
+	}
+	if err := client.open(ctx, &o, eps, 0); err != nil {
+		return nil, err
+	}
+	if o.KeepAliveInterval > 0 {
+		go client.keepAlive(&o)
+	}
+
+	return client, nil
+}
+
+// open connects to eps (or the endpoints found for the domain, if eps is nil)
+// and logs in, following see-other-host redirects (RFC 6120 4.9.3.19) until
+// o.MaxRedirects is exhausted.  redirects is the number already followed.
+func (c *Client) open(ctx context.Context, o *Options, eps []endpoint, redirects int) error {
+	defer func() { c.prev = nil }()
+	for {
+		c.sm, c.resumed = nil, false
+		f, err := c.connect(ctx, o, c.domain, eps)
+		if err == nil {
+			if err = c.init(ctx, o, f); err != nil {
+				c.conn.Close()
+			}
 		}
-		if strings.LastIndex(o.Host, ":") > 0 {
-			host = host[:strings.LastIndex(o.Host, ":")]
+		if !isSeeOtherHost(err) || redirects >= o.maxRedirects() {
+			return err
 		}
-		if err = tlsconn.VerifyHostname(host); err != nil {
-			return nil, err
+		redirects++
+		// The new host is contacted the way the old one was; its certificate
+		// must still be valid for the domain.
+		eps = []endpoint{hostEndpoint(err.(*StreamError).Data, c.endpoint.directTLS)}
+	}
+}
+
+// followRedirect reconnects to the host named by a see-other-host stream error
+// received after login, then joins again the rooms and sends again the
+// presence of the old stream unless the new one resumed it.  The login is done
+// on a client of its own, so that stanzas sent meanwhile fail on the old
+// connection instead of waiting for it, and Close gives it up.  If it fails,
+// c is left with the old connection.
+func (c *Client) followRedirect(se *StreamError) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
 		}
-		client.conn = tlsconn
+	}()
+
+	c.sendMu.Lock()
+	prev := c.sm
+	c.sm = nil
+	c.redirecting = true
+	c.conn.Close()
+	c.sendMu.Unlock()
+
+	nc := &Client{domain: c.domain, opts: c.opts, prev: prev, done: c.done}
+	err := nc.open(ctx, &nc.opts, []endpoint{hostEndpoint(se.Data, c.endpoint.directTLS)}, 1)
+	c.sendMu.Lock()
+	c.redirecting = false
+	if err == nil {
+		c.connMu.Lock()
+		c.conn, c.p, c.jid, c.endpoint = nc.conn, nc.p, nc.jid, nc.endpoint
+		c.connMu.Unlock()
+		c.sm, c.resumed, c.carbons, c.unacked = nc.sm, nc.resumed, nc.carbons, nc.unacked
+	}
+	c.sendMu.Unlock()
+	if err != nil {
+		return err
 	}
+	select {
+	case <-c.done:
+		// Close ran while we logged in, too late to stop it.
+		c.conn.Close()
+		return net.ErrClosed
+	default:
+	}
+	c.restore(c)
+	return nil
+}
 
-	if err := client.init(&o); err != nil {
-		client.Close()
-		return nil, err
+// replacing reports whether conn, the connection of c a moment ago, is being
+// or has been replaced by a redirect, so that its failure is not that of c.
+func (c *Client) replacing(conn net.Conn) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.redirecting || c.conn != conn
+}
+
+// parseUser parses Options.User, which must have a localpart.
+func parseUser(s string) (JID, error) {
+	j, err := ParseJID(s)
+	if err == nil && j.Local() == "" {
+		err = errors.New("xmpp: invalid username (want user@domain): " + s)
 	}
+	return j, err
+}
 
-	return client, nil
+// isSeeOtherHost reports whether err is a see-other-host stream error that
+// names a host.
+func isSeeOtherHost(err error) bool {
+	se, ok := err.(*StreamError)
+	return ok && se.Condition == CondSeeOtherHost && strings.TrimSpace(se.Data) != ""
+}
+
+// maxRedirects returns the number of see-other-host redirects to follow.
+func (o *Options) maxRedirects() int {
+	switch {
+	case o.MaxRedirects < 0:
+		return 0
+	case o.MaxRedirects == 0:
+		return 5
+	}
+	return o.MaxRedirects
 }
 
 // NewClient creates a new connection to a host given as "hostname" or "hostname:port".
-// If host is not specified, the  DNS SRV should be used to find the host from the domainpart of the JID.
+// If host is not specified, the DNS SRV records of the domainpart of the JID are used to find the host.
 // Default the port to 5222.
 func NewClient(host, user, passwd string, debug bool) (*Client, error) {
 	opts := Options{
@@ -218,222 +670,205 @@ func NewClientNoTLS(host, user, passwd string, debug bool) (*Client, error) {
 	return opts.NewClient()
 }
 
+// Close closes the connection, which makes writes blocked on it fail, without
+// waiting for them.
 func (c *Client) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
 	return c.conn.Close()
 }
 
+// writef writes a formatted stanza to the stream, keeping it in one piece
+// when several goroutines send at once.
+func (c *Client) writef(format string, a ...interface{}) (int, error) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.write(fmt.Sprintf(format, a...), true)
+}
+
 // xep-0045 7.2
 func (c *Client) JoinMUC(jid string) {
-	fmt.Fprintf(c.conn, "<presence to='%s'>\n" +
-				"<x xmlns='%s'><history maxstanzas='0'/></x>\n" +
-				"</presence>",
-		xmlEscape(jid), nsMUC)
+	c.stateMu.Lock()
+	if c.mucs == nil {
+		c.mucs = make(map[string]bool)
+	}
+	c.mucs[jid] = true
+	c.stateMu.Unlock()
+	c.SendPresence(Presence{To: jid, Extensions: []RawElement{{
+		XMLName:  xml.Name{Space: nsMUC, Local: "x"},
+		InnerXML: "<history maxstanzas='0'/>",
+	}}})
 }
 
 // xep-0045 7.14
 func (c *Client) LeaveMUC(jid string) {
-	fmt.Fprintf(c.conn, "<presence from='%s' to='%s' type='unavailable' />",
-		c.jid, xmlEscape(jid))
+	c.stateMu.Lock()
+	delete(c.mucs, jid)
+	c.stateMu.Unlock()
+	c.SendPresence(Presence{From: c.jid, To: jid, Type: "unavailable"})
 }
 
 // Keep alive (timetout occurs every 150s in hipchat.
+//
+// Deprecated: set Options.KeepAliveInterval instead.
 func (c *Client) KeepAlive() {
-	fmt.Fprintf(c.conn, " ")
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	c.write(" ", false)
 }
 
 // Change status when deploying
 func (c *Client) ChangeStatus(show string, status string) {
-	fmt.Fprintf(c.conn, "<presence xml:lang='en'><show>%s</show><status>%s</status></presence>", xmlEscape(show), xmlEscape(status))
-
+	c.SendPresence(Presence{Lang: "en", Show: show, Status: status})
 }
 
-func saslDigestResponse(username, realm, passwd, nonce, cnonceStr,
-	authenticate, digestUri, nonceCountStr string) string {
-	h := func(text string) []byte {
-		h := md5.New()
-		h.Write([]byte(text))
-		return h.Sum(nil)
-	}
-	hex := func(bytes []byte) string {
-		return fmt.Sprintf("%x", bytes)
-	}
-	kd := func(secret, data string) []byte {
-		return h(secret + ":" + data)
-	}
-
-	a1 := string(h(username + ":" + realm + ":" + passwd)) + ":" +
-			nonce + ":" + cnonceStr
-	a2 := authenticate + ":" + digestUri
-	response := hex(kd(hex(h(a1)), nonce+":" +
-				nonceCountStr+":"+cnonceStr+":auth:" +
-				hex(h(a2))))
-	return response
-}
-
-func cnonce() string {
-	randSize := big.NewInt(0)
-	randSize.Lsh(big.NewInt(1), 64)
-	cn, err := rand.Int(rand.Reader, randSize)
-	if err != nil {
-		return ""
+// init logs in on the stream whose features are f, within the limits set by
+// ctx, o.AuthTimeout and o.BindTimeout.
+func (c *Client) init(ctx context.Context, o *Options, f *streamFeatures) error {
+	done := c.withDeadline(ctx, o.AuthTimeout)
+	f, bound, err := c.login(o, f)
+	if err = done(err); err != nil {
+		return err
 	}
-	return fmt.Sprintf("%016x", cn)
+	done = c.withDeadline(ctx, o.BindTimeout)
+	return done(c.setup(o, f, bound))
 }
 
-func (c *Client) init(o *Options) error {
-	c.p = xml.NewDecoder(c.conn)
-	// For debugging: the following causes the plaintext of the connection to be duplicated to stdout.
-	if o.Debug {
-		c.p = xml.NewDecoder(tee{c.conn, os.Stdout})
-	}
+// login authenticates, and returns the stream features that apply once
+// authenticated and whether the resource was bound as well.
+func (c *Client) login(o *Options, f *streamFeatures) (_ *streamFeatures, bound bool, err error) {
+	domain := c.domain
 
-	a := strings.SplitN(o.User, "@", 2)
-	if len(a) != 2 {
-		return errors.New("xmpp: invalid username (want user@domain): " + o.User)
+	// Even digest forms of authentication are unsafe if we do not know that the host
+	// we are talking to is the actual server, and not a man in the middle playing
+	// proxy.
+	if !c.isEncrypted() && !o.InsecureAllowUnencryptedAuth {
+		return nil, false, errors.New("refusing to authenticate over unencrypted TCP connection")
 	}
-	domain := a[1]
 
-	// Declare intent to be a jabber client and gather stream features.
-	f, err := c.startStream(o, domain)
+	user, err := parseUser(o.User)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
-
-	// If the server requires we STARTTLS, attempt to do so.
-	if f, err = c.startTlsIfRequired(f, o, domain); err != nil {
-		return err
+	info := &SASLInfo{
+		User:       user.Local(),
+		Domain:     domain,
+		Password:   o.Password,
+		AuthzID:    o.AuthzID,
+		Mechanisms: f.Mechanisms.Mechanism,
 	}
-
-	// Even digest forms of authentication are unsafe if we do not know that the host
-	// we are talking to is the actual server, and not a man in the middle playing
-	// proxy.
-	if !c.IsEncrypted() && !o.InsecureAllowUnencryptedAuth {
-		return errors.New("refusing to authenticate over unencrypted TCP connection")
+	if t, ok := c.conn.(*tls.Conn); ok {
+		cs := t.ConnectionState()
+		info.TLS = &cs
+		tc := o.tlsConfig(domain)
+		info.ClientCertificate = len(tc.Certificates) > 0 || tc.GetClientCertificate != nil
 	}
-
-	mechanism := ""
-	for _, m := range f.Mechanisms.Mechanism {
-		if m == "ANONYMOUS" {
-			mechanism = m
-			fmt.Fprintf(c.conn, "<auth xmlns='%s' mechanism='ANONYMOUS' />\n", nsSASL)
-			break
+	if f.ChannelBinding != nil {
+		for _, cb := range f.ChannelBinding.ChannelBinding {
+			info.ChannelBindings = append(info.ChannelBindings, cb.Type)
 		}
+	}
 
-		a := strings.SplitN(o.User, "@", 2)
-		if len(a) != 2 {
-			return errors.New("xmpp: invalid username (want user@domain): " + o.User)
+	if f.Authentication != nil {
+		// SASL2 authenticates, and possibly binds, without restarting the stream.
+		info.Mechanisms = f.Authentication.Mechanism
+		if f.SM == nil {
+			f.SM = f.Authentication.Inline.SM
 		}
-		user := a[0]
-		domain := a[1]
+		bound, err = c.authenticate2(o, f.Authentication, info)
+		return f, bound, err
+	}
+	if err = c.authenticate(o.Mechanisms, info); err != nil {
+		return nil, false, err
+	}
 
-		if m == "PLAIN" {
-			mechanism = m
-			// Plain authentication: send base64-encoded \x00 user \x00 password.
-			raw := "\x00" + user + "\x00" + o.Password
-			enc := make([]byte, base64.StdEncoding.EncodedLen(len(raw)))
-			base64.StdEncoding.Encode(enc, []byte(raw))
-			fmt.Fprintf(c.conn, "<auth xmlns='%s' mechanism='PLAIN'>%s</auth>\n",
-				nsSASL, enc)
-			break
+	// Now that we're authenticated, we're supposed to start the stream over again.
+	// Declare intent to be a jabber client.
+	f, err = c.startStream(o, domain)
+	return f, false, err
+}
+
+// setup resumes the previous stream, or else binds the resource unless that is
+// done already, enables carbons and stream management and sends the initial
+// presence.  f are the stream features once authenticated.
+func (c *Client) setup(o *Options, f *streamFeatures, bound bool) error {
+	var err error
+	if c.resumed {
+		return nil
+	}
+	if !bound && c.prev != nil && c.prev.canResume() && f.SM != nil {
+		if c.resumed, err = c.smResume(); err != nil || c.resumed {
+			return err
 		}
-		if m == "DIGEST-MD5" {
-			mechanism = m
-			// Digest-MD5 authentication
-			fmt.Fprintf(c.conn, "<auth xmlns='%s' mechanism='DIGEST-MD5'/>\n",
-				nsSASL)
-			var ch saslChallenge
-			if err = c.p.DecodeElement(&ch, nil); err != nil {
-				return errors.New("unmarshal <challenge>: " + err.Error())
-			}
-			b, err := base64.StdEncoding.DecodeString(string(ch))
-			if err != nil {
-				return err
-			}
-			tokens := map[string]string{}
-			for _, token := range strings.Split(string(b), ",") {
-				kv := strings.SplitN(strings.TrimSpace(token), "=", 2)
-				if len(kv) == 2 {
-					if kv[1][0] == '"' && kv[1][len(kv[1])-1] == '"' {
-						kv[1] = kv[1][1 : len(kv[1])-1]
-					}
-					tokens[kv[0]] = kv[1]
-				}
-			}
-			realm, _ := tokens["realm"]
-			nonce, _ := tokens["nonce"]
-			qop, _ := tokens["qop"]
-			charset, _ := tokens["charset"]
-			cnonceStr := cnonce()
-			digestUri := "xmpp/" + domain
-			nonceCount := fmt.Sprintf("%08x", 1)
-			digest := saslDigestResponse(user, realm, o.Password, nonce, cnonceStr, "AUTHENTICATE", digestUri, nonceCount)
-			message := "username=\"" + user + "\", realm=\"" + realm + "\", nonce=\"" + nonce + "\", cnonce=\"" + cnonceStr + "\", nc=" + nonceCount + ", qop=" + qop + ", digest-uri=\"" + digestUri + "\", response=" + digest + ", charset=" + charset
-
-			fmt.Fprintf(c.conn, "<response xmlns='%s'>%s</response>\n", nsSASL, base64.StdEncoding.EncodeToString([]byte(message)))
-
-			var rspauth saslRspAuth
-			if err = c.p.DecodeElement(&rspauth, nil); err != nil {
-				return errors.New("unmarshal <challenge>: " + err.Error())
-			}
-			b, err = base64.StdEncoding.DecodeString(string(rspauth))
-			if err != nil {
-				return err
-			}
-			fmt.Fprintf(c.conn, "<response xmlns='%s'/>\n", nsSASL)
-			break
+	}
+	if !bound {
+		if err = c.bind(o); err != nil {
+			return err
 		}
 	}
-	if mechanism == "" {
-		return errors.New(fmt.Sprintf("PLAIN authentication is not an option: %v", f.Mechanisms.Mechanism))
+
+	if o.Carbons && !c.carbons {
+		iq, err := c.syncIQ(IQ{Type: "set", ID: fmt.Sprintf("%x", getCookie()), Payload: "<enable xmlns='" + nsCarbons + "'/>"})
+		if err != nil {
+			return err
+		}
+		c.carbons = iq.Type == "result"
 	}
 
-	// Next message should be either success or failure.
-	name, val, err := next(c.p)
+	if o.StreamManagement && c.sm == nil && f.SM != nil {
+		if err = c.smEnable(); err != nil {
+			return err
+		}
+	}
+
+	// We're connected and can now receive and send messages.
+	presence, err := Presence{Lang: "en", Show: o.Status, Status: o.StatusMessage}.xml()
 	if err != nil {
 		return err
 	}
-	switch v := val.(type) {
-	case *saslSuccess:
-	case *saslFailure:
-		// v.Any is type of sub-element in failure,
-		// which gives a description of what failed.
-		return errors.New("auth failure: " + v.Any.Local)
-	default:
-		return errors.New("expected <success> or <failure>, got <" + name.Local + "> in " + name.Space)
-	}
-
-	// Now that we're authenticated, we're supposed to start the stream over again.
-	// Declare intent to be a jabber client.
-	if f, err = c.startStream(o, domain); err != nil {
+	if _, err = c.write(presence, true); err != nil {
 		return err
 	}
 
-	//Generate uniq cookie
-	cookie := getCookie()
+	if c.prev != nil {
+		// The previous stream is gone along with what the server had not
+		// acknowledged, which restore sends again once it has joined the
+		// rooms again.
+		c.unacked = c.prev.queue
+	}
+	return nil
+}
 
+// bind binds a resource with RFC 6120 7 and opens a session if o.Session is set.
+func (c *Client) bind(o *Options) error {
 	// Send IQ message asking to bind to the local user name.
-	if o.Resource == "" {
-		fmt.Fprintf(c.conn, "<iq type='set' id='%x'><bind xmlns='%s'></bind></iq>\n", cookie, nsBind)
-	} else {
-		fmt.Fprintf(c.conn, "<iq type='set' id='%x'><bind xmlns='%s'><resource>%s</resource></bind></iq>\n", cookie, nsBind, o.Resource)
+	payload := "<bind xmlns='" + nsBind + "'></bind>"
+	if o.Resource != "" {
+		payload = fmt.Sprintf("<bind xmlns='%s'><resource>%s</resource></bind>", nsBind, xmlEscape(o.Resource))
+	}
+	iq, err := c.syncIQ(IQ{Type: "set", ID: fmt.Sprintf("%x", getCookie()), Payload: payload})
+	if err != nil {
+		return err
 	}
-	var iq clientIQ
-	if err = c.p.DecodeElement(&iq, nil); err != nil {
-		return errors.New("unmarshal <iq>: " + err.Error())
+	if iq.Type == "error" {
+		return iq.iq().Error
 	}
-	if &iq.Bind == nil {
+	if iq.Bind.Jid == "" {
 		return errors.New("<iq> result missing <bind>")
 	}
 	c.jid = iq.Bind.Jid // our local id
 
 	if o.Session {
 		//if server support session, open it
-		fmt.Fprintf(c.conn, "<iq to='%s' type='set' id='%x'><session xmlns='%s'/></iq>", xmlEscape(domain), cookie, NsSession)
+		iq, err = c.syncIQ(IQ{Type: "set", ID: fmt.Sprintf("%x", getCookie()), To: c.domain, Payload: "<session xmlns='" + NsSession + "'/>"})
+		if err != nil {
+			return err
+		}
+		if iq.Type == "error" {
+			return iq.iq().Error
+		}
 	}
-
-	// We're connected and can now receive and send messages.
-	fmt.Fprintf(c.conn, "<presence xml:lang='en'><show>%s</show><status>%s</status></presence>", o.Status, o.StatusMessage)
-
 	return nil
 }
 
@@ -442,33 +877,48 @@ func (c *Client) init(o *Options) error {
 func (c *Client) startTlsIfRequired(f *streamFeatures, o *Options, domain string) (*streamFeatures, error) {
 	// whether we start tls is a matter of opinion: the server's and the user's.
 	switch {
+	case c.isEncrypted():
+		// we are already talking TLS to a direct TLS endpoint.
+		return f, nil
 	case f.StartTLS == nil:
-		// the server does not support STARTTLS
+		// the server does not support STARTTLS.
+		if o.tlsRequired() {
+			return f, ErrStartTLSUnavailable
+		}
+		return f, nil
+	case o.TLSPolicy == TLSDisabled:
+		// the user refuses TLS.
+		if f.StartTLS.Required != nil {
+			return f, ErrStartTLSRequired
+		}
 		return f, nil
 	case f.StartTLS.Required != nil:
 		// the server requires STARTTLS.
-	case !o.StartTLS:
+	case o.StartTLS || o.tlsRequired():
 		// the user wants STARTTLS and the server supports it.
+	default:
+		// the server offers STARTTLS but the user does not want it.
+		return f, nil
 	}
-	var err error
 
-	fmt.Fprintf(c.conn, "<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>\n")
-	var k tlsProceed
-	if err = c.p.DecodeElement(&k, nil); err != nil {
-		return f, errors.New("unmarshal <proceed>: "+err.Error())
+	fmt.Fprintf(c.conn, "<starttls xmlns='%s'/>\n", nsTLS)
+	name, val, err := next(c.p)
+	if err != nil {
+		return f, err
 	}
-
-	tc := o.TLSConfig
-	if tc == nil {
-		tc = new(tls.Config)
-		*tc = DefaultConfig
-		//TODO(scott): we should consider using the server's address or reverse lookup
-		tc.ServerName = domain
+	switch v := val.(type) {
+	case *tlsProceed:
+	case *tlsFailure:
+		return f, ErrStartTLSFailed
+	case *StreamError:
+		return f, v
+	default:
+		return f, errors.New("expected <proceed> or <failure>, got <" + name.Local + "> in " + name.Space)
 	}
-	t := tls.Client(c.conn, tc)
 
+	t := tls.Client(c.conn, o.tlsConfig(domain))
 	if err = t.Handshake(); err != nil {
-		return f, errors.New("starttls handshake: "+err.Error())
+		return f, fmt.Errorf("starttls handshake: %w", err)
 	}
 	c.conn = t
 
@@ -509,86 +959,246 @@ func (c *Client) startStream(o *Options, domain string) (*streamFeatures, error)
 	// Now we're in the stream and can use Unmarshal.
 	// Next message should be <features> to tell us authentication options.
 	// See section 4.6 in RFC 3920.
-	f := new(streamFeatures)
-	if err = c.p.DecodeElement(f, nil); err != nil {
-		return f, errors.New("unmarshal <features>: "+err.Error())
+	name, val, err := next(c.p)
+	if err != nil {
+		return nil, errors.New("unmarshal <features>: " + err.Error())
 	}
-	return f, nil
+	switch v := val.(type) {
+	case *streamFeatures:
+		return v, nil
+	case *StreamError:
+		return nil, v
+	}
+	return nil, errors.New("expected <features>, got <" + name.Local + "> in " + name.Space)
 }
 
 // IsEncrypted will return true if the client is connected using a TLS transport, either because it used
 // TLS to connect from the outset, or because it successfully used STARTTLS to promote a TCP connection
 // to TLS.
 func (c *Client) IsEncrypted() bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.isEncrypted()
+}
+
+func (c *Client) isEncrypted() bool {
 	_, ok := c.conn.(*tls.Conn)
 	return ok
 }
 
+// Chat is a <message/> stanza, as returned by Recv and sent by Send.
 type Chat struct {
-	Remote string
+	Remote string // from on receipt, to when sending
 	Type   string
 	Text   string
-	Other  []string
+	Other  []string     // character data of the Extensions
+	Error  *StanzaError // set if Type is "error"
+
+	ID   string
+	To   string // on receipt, the address the message was sent to
+	Lang string // xml:lang of the message; Send defaults it to "en"
+
+	// RemoteJID and ToJID are Remote and To parsed on receipt, or the zero
+	// JID if they are not valid.  When sending, RemoteJID is used if Remote
+	// is empty.
+	RemoteJID JID
+	ToJID     JID
+
+	// Subject and Text are the subject and body in the language of the
+	// message.  Subjects and Bodies hold them in every language sent; when
+	// sending, they take precedence over Subject and Text if set.
+	Subject  string
+	Subjects []Text
+	Bodies   []Text
+
+	Thread       string
+	ThreadParent string
+
+	HTML *XHTML // sanitized XHTML-IM body (XEP-0071), if any
+
+	// Extensions are the child elements other than body, subject, thread
+	// and error, such as chat states or receipts, that were not decoded
+	// into Payloads.
+	Extensions []RawElement
+	Payloads   []interface{} // see RegisterPayload
 }
 
+// Presence is a <presence/> stanza, as returned by Recv and sent by
+// SendPresence.
 type Presence struct {
-	From string
-	To   string
-	Type string
-	Show string
+	From  string
+	To    string
+	Type  string
+	Show  string
+	Error *StanzaError // set if Type is "error"
+
+	ID   string
+	Lang string // xml:lang of the presence
+
+	// FromJID and ToJID are From and To parsed on receipt, or the zero JID
+	// if they are not valid.  When sending, they are used if From or To is
+	// empty.
+	FromJID JID
+	ToJID   JID
+
+	// Status is the status text in the language of the presence.  Statuses
+	// holds it in every language sent; when sending, it takes precedence
+	// over Status if set.
+	Status   string
+	Statuses []Text
+	Priority int
+
+	MUCUser *MUCUser // occupant information from a room (XEP-0045); not sent
+	Caps    *Caps    // entity capabilities (XEP-0115)
+
+	// Extensions are the child elements other than those above that were
+	// not decoded into Payloads.
+	Extensions []RawElement
+	Payloads   []interface{} // see RegisterPayload
 }
 
 // Recv wait next token of chat.
+// Responses to SendIQ are consumed by Recv, and pings (XEP-0199) answered; other
+// <iq/> stanzas are returned as IQ, and unknown top-level elements as RawElement
+// (see Options.StrictParsing).
+// If the server sends a stream error, it is returned as a *StreamError, except for
+// see-other-host which makes the client reconnect to the named host and log in again.
 func (c *Client) Recv() (event interface{}, err error) {
+	return c.RecvContext(context.Background())
+}
+
+// RecvContext is like Recv, but returns ctx.Err() once ctx is done.  The
+// stream is left intact: a stanza that arrives afterwards is returned by the
+// next call to Recv or RecvContext.
+func (c *Client) RecvContext(ctx context.Context) (event interface{}, err error) {
+	if !atomic.CompareAndSwapInt32(&c.reading, 0, 1) {
+		return Chat{}, ErrConcurrentRecv
+	}
+	defer atomic.StoreInt32(&c.reading, 0)
+	for {
+		event, _, err = c.recvContext(ctx)
+		if iq, ok := event.(IQ); ok && err == nil && isPing(iq) {
+			if err = c.SendIQResult(iq, ""); err != nil {
+				return Chat{}, err
+			}
+			continue
+		}
+		return event, err
+	}
+}
+
+type recvResult struct {
+	event   interface{}
+	payload []xml.Name
+	err     error
+}
+
+// recvContext is recv, giving up once ctx is done.  The read itself carries on
+// in the background and its result is kept for the next call.
+func (c *Client) recvContext(ctx context.Context) (interface{}, []xml.Name, error) {
+	if c.inflight == nil {
+		if ctx.Done() == nil {
+			return c.recv()
+		}
+		ch := make(chan recvResult, 1)
+		go func() {
+			event, payload, err := c.recv()
+			ch <- recvResult{event, payload, err}
+		}()
+		c.inflight = ch
+	}
+	select {
+	case r := <-c.inflight:
+		c.inflight = nil
+		return r.event, r.payload, r.err
+	case <-ctx.Done():
+		return Chat{}, nil, ctx.Err()
+	}
+}
+
+// recv is Recv, also returning the names of the stanza's child elements.
+func (c *Client) recv() (event interface{}, payload []xml.Name, err error) {
 	for {
 		_, val, err := next(c.p)
 		if err != nil {
-			return Chat{}, err
+			c.abortIQs()
+			return Chat{}, nil, err
+		}
+		c.sendMu.Lock()
+		sm := c.smInbound(val)
+		c.sendMu.Unlock()
+		if sm {
+			continue
 		}
 		switch v := val.(type) {
 		case *clientMessage:
-			return Chat{v.From, v.Type, v.Body, v.Other}, nil
+			return v.chat(), payloadNames(v.Inner), nil
 		case *clientPresence:
-			return Presence{v.From, v.To, v.Type, v.Show}, nil
+			return v.presence(), payloadNames(v.Inner), nil
+		case *clientIQ:
+			iq := v.iq()
+			if (iq.Type == "result" || iq.Type == "error") && c.deliverIQ(iq) {
+				continue
+			}
+			return iq, payloadNames(v.Payload), nil
+		case *StreamError:
+			c.abortIQs()
+			if isSeeOtherHost(v) && c.opts.maxRedirects() > 0 {
+				// Transparently move to the new host and carry on.
+				if err := c.followRedirect(v); err != nil {
+					return Chat{}, nil, err
+				}
+				continue
+			}
+			return Chat{}, nil, v
+		case *RawElement:
+			if c.opts.StrictParsing {
+				return Chat{}, nil, errors.New("unexpected XMPP message " +
+					v.XMLName.Space + " <" + v.XMLName.Local + "/>")
+			}
+			return *v, nil, nil
 		}
 	}
-	panic("unreachable")
 }
 
 
-// Send sends the message wrapped inside an XMPP message stanza body.
+// Send sends chat as a message stanza to chat.Remote.
 func (c *Client) Send(chat Chat) (n int, err error) {
-	return fmt.Fprintf(c.conn, "<message to='%s' type='%s' xml:lang='en'>"+"<body>%s</body></message>",
-		xmlEscape(chat.Remote), xmlEscape(chat.Type), xmlEscape(chat.Text))
+	s, err := chat.xml()
+	if err != nil {
+		return 0, err
+	}
+	return c.writef("%s", s)
 }
 
-// SendHtml sends the message as HTML as defined by XEP-0071
+// SendHtml sends the message as HTML as defined by XEP-0071: it is SendXHTML
+// with chat.Text as the HTML.
 func (c *Client) SendHtml(chat Chat) (n int, err error) {
-	return fmt.Fprintf(c.conn, "<message to='%s' type='%s' xml:lang='en'>"+
-		"<body>%s</body>"+
-		"<html xmlns='http://jabber.org/protocol/xhtml-im'><body xmlns='http://www.w3.org/1999/xhtml'>%s</body></html></message>",
-		xmlEscape(chat.Remote), xmlEscape(chat.Type), xmlEscape(chat.Text), chat.Text)
+	html := chat.Text
+	chat.Text = ""
+	return c.SendXHTML(chat, html)
 }
 
 
-// Send origin
+// Send origin, written to the stream as is.  Unlike the other methods that
+// send, SendOrg does not check or escape anything: org must be trusted, well
+// formed XML, or it breaks the stream.
 func (c *Client) SendOrg(org string) {
-	fmt.Fprint(c.conn, org)
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	c.write(org, isStanza(org))
 }
 
 // RFC 3920  C.1  Streams name space
 type streamFeatures struct {
-	XMLName    xml.Name `xml:"http://etherx.jabber.org/streams features"`
-	StartTLS   *tlsStartTLS
-	Mechanisms saslMechanisms
-	Bind       bindBind
-	Session    bool
-}
-
-type streamError struct {
-	XMLName xml.Name `xml:"http://etherx.jabber.org/streams error"`
-	Any     xml.Name
-	Text    string
+	XMLName        xml.Name `xml:"http://etherx.jabber.org/streams features"`
+	StartTLS       *tlsStartTLS
+	Mechanisms     saslMechanisms
+	ChannelBinding *saslChannelBinding
+	Authentication *sasl2Authentication
+	Bind           bindBind
+	Session        bool
+	SM             *smFeature
 }
 
 // RFC 3920  C.3  TLS name space
@@ -613,6 +1223,15 @@ type saslMechanisms struct {
 	Mechanism []string `xml:"mechanism"`
 }
 
+// XEP-0440  SASL Channel-Binding Type Capability
+
+type saslChannelBinding struct {
+	XMLName        xml.Name `xml:"urn:xmpp:sasl-cb:0 sasl-channel-binding"`
+	ChannelBinding []struct {
+		Type string `xml:"type,attr"`
+	} `xml:"channel-binding"`
+}
+
 type saslAuth struct {
 	XMLName   xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl auth"`
 	Mechanism string   `xml:",attr"`
@@ -630,11 +1249,7 @@ type saslAbort struct {
 
 type saslSuccess struct {
 	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl success"`
-}
-
-type saslFailure struct {
-	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl failure"`
-	Any     xml.Name
+	Data    string   `xml:",chardata"` // additional data with success, base64
 }
 
 // RFC 3920  C.5  Resource binding name space
@@ -653,20 +1268,28 @@ type clientMessage struct {
 	Id      string   `xml:"id,attr"`
 	To      string   `xml:"to,attr"`
 	Type    string   `xml:"type,attr"` // chat, error, groupchat, headline, or normal
+	Lang    string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+
+	Subject []clientText `xml:"jabber:client subject"`
+	Body    []clientText `xml:"jabber:client body"`
+	Thread  clientThread `xml:"jabber:client thread"`
 
-	// These should technically be []clientText,
-	// but string is much more convenient.
-	Subject string `xml:"subject"`
-	Body    string `xml:"body"`
-	Thread  string `xml:"thread"`
+	Error *StanzaError `xml:"error"`
 
 	// Any hasn't matched element
-	Other []string `xml:",any"`
+	Other []RawElement `xml:",any"`
+
+	Inner string `xml:",innerxml"`
 }
 
 type clientText struct {
-	Lang string `xml:",attr"`
-	Body string `xml:"chardata"`
+	Lang string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+	Body string `xml:",chardata"`
+}
+
+type clientThread struct {
+	Parent string `xml:"parent,attr"`
+	ID     string `xml:",chardata"`
 }
 
 type clientPresence struct {
@@ -675,30 +1298,34 @@ type clientPresence struct {
 	Id      string   `xml:"id,attr"`
 	To      string   `xml:"to,attr"`
 	Type    string   `xml:"type,attr"` // error, probe, subscribe, subscribed, unavailable, unsubscribe, unsubscribed
-	Lang    string   `xml:"lang,attr"`
-
-	Show     string `xml:"show"`        // away, chat, dnd, xa
-	Status   string `xml:"status,attr"` // sb []clientText
-	Priority string `xml:"priority,attr"`
-	Error    *clientError
+	Lang    string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+
+	Show     string         `xml:"jabber:client show"` // away, chat, dnd, xa
+	Status   []clientText   `xml:"jabber:client status"`
+	Priority string         `xml:"jabber:client priority"`
+	MUCUser  *clientMUCUser `xml:"http://jabber.org/protocol/muc#user x"`
+	Caps     *clientCaps    `xml:"http://jabber.org/protocol/caps c"`
+	Error    *StanzaError   `xml:"error"`
+	Other    []RawElement   `xml:",any"`
+	Inner    string         `xml:",innerxml"`
 }
 
 type clientIQ struct { // info/query
-	XMLName xml.Name `xml:"jabber:client iq"`
-	From    string   `xml:",attr"`
-	Id      string   `xml:",attr"`
-	To      string   `xml:",attr"`
-	Type    string   `xml:",attr"` // error, get, result, set
-	Error   clientError
+	XMLName xml.Name     `xml:"jabber:client iq"`
+	From    string       `xml:"from,attr"`
+	Id      string       `xml:"id,attr"`
+	To      string       `xml:"to,attr"`
+	Type    string       `xml:"type,attr"` // error, get, result, set
+	Error   *StanzaError `xml:"error"`
 	Bind    bindBind
+	Payload string `xml:",innerxml"`
 }
 
-type clientError struct {
-	XMLName xml.Name `xml:"jabber:client error"`
-	Code    string   `xml:",attr"`
-	Type    string   `xml:",attr"`
-	Any     xml.Name
-	Text    string
+// RawElement is an XML element that is kept as is rather than decoded.
+type RawElement struct {
+	XMLName  xml.Name
+	Attr     []xml.Attr `xml:",any,attr"`
+	InnerXML string     `xml:",innerxml"`
 }
 
 // Scan XML token stream to find next StartElement.
@@ -718,6 +1345,7 @@ func nextStart(p *xml.Decoder) (xml.StartElement, error) {
 
 // Scan XML token stream for next element and save into val.
 // If val == nil, allocate new element based on proto map.
+// Elements that are not in the map are returned as *RawElement.
 // Either way, return val.
 func next(p *xml.Decoder) (xml.Name, interface{}, error) {
 	// Read start element to find out what type we want.
@@ -732,7 +1360,7 @@ func next(p *xml.Decoder) (xml.Name, interface{}, error) {
 	case nsStream + " features":
 		nv = &streamFeatures{}
 	case nsStream + " error":
-		nv = &streamError{}
+		nv = &StreamError{}
 	case nsTLS + " starttls":
 		nv = &tlsStartTLS{}
 	case nsTLS + " proceed":
@@ -742,15 +1370,23 @@ func next(p *xml.Decoder) (xml.Name, interface{}, error) {
 	case nsSASL + " mechanisms":
 		nv = &saslMechanisms{}
 	case nsSASL + " challenge":
-		nv = ""
+		nv = new(saslChallenge)
 	case nsSASL + " response":
-		nv = ""
+		nv = new(saslResponse)
 	case nsSASL + " abort":
 		nv = &saslAbort{}
 	case nsSASL + " success":
 		nv = &saslSuccess{}
 	case nsSASL + " failure":
-		nv = &saslFailure{}
+		nv = &AuthError{}
+	case nsSASL2 + " challenge":
+		nv = new(sasl2Challenge)
+	case nsSASL2 + " success":
+		nv = &sasl2Success{}
+	case nsSASL2 + " failure":
+		nv = &AuthError{}
+	case nsSASL2 + " continue":
+		nv = &sasl2Continue{}
 	case nsBind + " bind":
 		nv = &bindBind{}
 	case nsClient + " message":
@@ -760,37 +1396,36 @@ func next(p *xml.Decoder) (xml.Name, interface{}, error) {
 	case nsClient + " iq":
 		nv = &clientIQ{}
 	case nsClient + " error":
-		nv = &clientError{}
+		nv = &StanzaError{}
+	case nsSM + " enabled":
+		nv = &smEnabled{}
+	case nsSM + " resumed":
+		nv = &smResumed{}
+	case nsSM + " failed":
+		nv = &smFailed{}
+	case nsSM + " r":
+		nv = &smRequest{}
+	case nsSM + " a":
+		nv = &smAck{}
 	default:
-		return xml.Name{}, nil, errors.New("unexpected XMPP message " +
-				se.Name.Space+" <"+se.Name.Local+"/>")
+		nv = &RawElement{}
 	}
 
 	// Unmarshal into that storage.
 	if err = p.DecodeElement(nv, &se); err != nil {
 		return xml.Name{}, nil, err
 	}
+	if e, ok := nv.(*RawElement); ok {
+		e.Attr = stripXMLNS(e.Attr)
+	}
 	return se.Name, nv, err
 }
 
-var xmlSpecial = map[byte]string{
-	'<':  "&lt;",
-	'>':  "&gt;",
-	'"':  "&quot;",
-	'\'': "&apos;",
-	'&':  "&amp;",
-}
-
+// xmlEscape escapes s for use in character data or an attribute value,
+// replacing characters that XML does not allow with U+FFFD.
 func xmlEscape(s string) string {
 	var b bytes.Buffer
-	for i := 0; i < len(s); i++ {
-		c := s[i]
-		if s, ok := xmlSpecial[c]; ok {
-			b.WriteString(s)
-		} else {
-			b.WriteByte(c)
-		}
-	}
+	xml.EscapeText(&b, []byte(s))
 	return b.String()
 }
 
@@ -0,0 +1,241 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Outgoing stanzas are encoded with encoding/xml from the types below, which
+// escapes text and attribute values and replaces characters that XML does not
+// allow with U+FFFD.  Raw XML supplied by the user, such as IQ.Payload or the
+// inner XML of a RawElement, is parsed and encoded again token by token, so
+// that it is rejected unless it is well-formed, and cannot close the stanza it
+// is put in.
+
+type outMessage struct {
+	XMLName    xml.Name     `xml:"message"`
+	ID         string       `xml:"id,attr,omitempty"`
+	To         string       `xml:"to,attr,omitempty"`
+	Type       string       `xml:"type,attr,omitempty"`
+	Lang       string       `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Subject    []outText    `xml:"subject"`
+	Body       []outText    `xml:"body"`
+	Thread     *outThread   `xml:"thread"`
+	HTML       *XHTML       `xml:",omitempty"`
+	Extensions []RawElement `xml:",omitempty"`
+	Raw        rawXML       `xml:",omitempty"`
+}
+
+type outPresence struct {
+	XMLName    xml.Name     `xml:"presence"`
+	ID         string       `xml:"id,attr,omitempty"`
+	From       string       `xml:"from,attr,omitempty"`
+	To         string       `xml:"to,attr,omitempty"`
+	Type       string       `xml:"type,attr,omitempty"`
+	Lang       string       `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Show       string       `xml:"show,omitempty"`
+	Status     []outText    `xml:"status"`
+	Priority   int          `xml:"priority,omitempty"`
+	Caps       *outCaps     `xml:"http://jabber.org/protocol/caps c"`
+	Extensions []RawElement `xml:",omitempty"`
+	Raw        rawXML       `xml:",omitempty"`
+	Error      *StanzaError `xml:"error"`
+}
+
+type outIQ struct {
+	XMLName xml.Name     `xml:"iq"`
+	ID      string       `xml:"id,attr"`
+	To      string       `xml:"to,attr,omitempty"`
+	Type    string       `xml:"type,attr"`
+	Payload rawXML       `xml:",omitempty"`
+	Raw     rawXML       `xml:",omitempty"`
+	Error   *StanzaError `xml:"error"`
+}
+
+type outText struct {
+	Lang string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Text string `xml:",chardata"`
+}
+
+type outThread struct {
+	Parent string `xml:"parent,attr,omitempty"`
+	ID     string `xml:",chardata"`
+}
+
+type outCaps struct {
+	Hash string `xml:"hash,attr"`
+	Node string `xml:"node,attr"`
+	Ver  string `xml:"ver,attr"`
+}
+
+// outTexts returns all, or text alone if all is empty.
+func outTexts(text string, all []Text) []outText {
+	var out []outText
+	if len(all) == 0 && text != "" {
+		out = append(out, outText{Text: text})
+	}
+	for _, t := range all {
+		out = append(out, outText{Lang: t.Lang, Text: t.Text})
+	}
+	return out
+}
+
+// encode returns the XML encoding of v.
+func encode(v interface{}) (string, error) {
+	out, err := xml.Marshal(v)
+	if err != nil {
+		return "", errors.New("xmpp: cannot encode stanza: " + err.Error())
+	}
+	return string(out), nil
+}
+
+// marshalPayloads returns the XML encoding of payloads, for a rawXML field.
+func marshalPayloads(payloads []interface{}) (rawXML, error) {
+	var b strings.Builder
+	for _, v := range payloads {
+		out, err := xml.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		b.Write(out)
+	}
+	return rawXML(b.String()), nil
+}
+
+// rawXML is a fragment of XML, such as the children of an element, that is
+// checked and encoded again when marshalled.
+type rawXML string
+
+func (r rawXML) MarshalXML(enc *xml.Encoder, _ xml.StartElement) error {
+	return encodeFragment(enc, string(r), "", nil)
+}
+
+// MarshalXML encodes e, checking its names and inner XML.
+func (e RawElement) MarshalXML(enc *xml.Encoder, _ xml.StartElement) error {
+	if !isName(e.XMLName.Local) {
+		return errors.New("xmpp: invalid element name " + e.XMLName.Local)
+	}
+	start := xml.StartElement{Name: e.XMLName}
+	var decls []xml.Attr
+	for _, a := range e.Attr {
+		if a.Name.Space == "xmlns" || a.Name.Space == "" && a.Name.Local == "xmlns" {
+			decls = append(decls, a)
+			continue
+		}
+		if !isName(a.Name.Local) {
+			return errors.New("xmpp: invalid attribute name " + a.Name.Local)
+		}
+		start.Attr = append(start.Attr, a)
+	}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if err := encodeFragment(enc, e.InnerXML, e.XMLName.Space, decls); err != nil {
+		return err
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// encodeFragment parses inner, XML found within an element whose default
+// namespace is space and which declares the prefixes in decls, and encodes
+// its tokens with enc.  Comments and processing instructions, which RFC 6120
+// 11.1 forbids, are dropped.
+func encodeFragment(enc *xml.Encoder, inner, space string, decls []xml.Attr) error {
+	if inner == "" {
+		return nil
+	}
+	var w strings.Builder
+	w.WriteString("<w")
+	if space != "" {
+		w.WriteString(" xmlns='" + xmlEscape(space) + "'")
+	}
+	for _, a := range decls {
+		if a.Name.Space == "xmlns" && isName(a.Name.Local) {
+			w.WriteString(" xmlns:" + a.Name.Local + "='" + xmlEscape(a.Value) + "'")
+		}
+	}
+	w.WriteString(">" + inner + "</w>")
+
+	// spaces holds the namespace of each open element, so that children in
+	// the namespace of their parent can leave it to the parent to declare.
+	spaces := []string{space}
+	wrapped := false
+	d := xml.NewDecoder(strings.NewReader(w.String()))
+	for depth := 0; ; {
+		t, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.New("xmpp: invalid raw XML: " + err.Error())
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 1 {
+				if wrapped {
+					// inner closed the wrapper and opened another.
+					return errors.New("xmpp: invalid raw XML: unbalanced elements")
+				}
+				wrapped = true
+				continue
+			}
+			// The decoder checks a prefixed name as a whole, not its
+			// local part, which is all that gets encoded.
+			if !isName(t.Name.Local) {
+				return errors.New("xmpp: invalid raw XML: invalid element name " + t.Name.Local)
+			}
+			parent := spaces[len(spaces)-1]
+			spaces = append(spaces, t.Name.Space)
+			if t.Name.Space == parent {
+				t.Name.Space = ""
+			}
+			attr := t.Attr[:0]
+			for _, a := range t.Attr {
+				if a.Name.Space == "xmlns" || a.Name.Space == "" && a.Name.Local == "xmlns" {
+					continue
+				}
+				if !isName(a.Name.Local) {
+					return errors.New("xmpp: invalid raw XML: invalid attribute name " + a.Name.Local)
+				}
+				attr = append(attr, a)
+			}
+			t.Attr = attr
+			err = enc.EncodeToken(t)
+		case xml.EndElement:
+			depth--
+			if depth == 0 {
+				continue
+			}
+			spaces = spaces[:len(spaces)-1]
+			if t.Name.Space == spaces[len(spaces)-1] {
+				t.Name.Space = ""
+			}
+			err = enc.EncodeToken(t)
+		case xml.CharData:
+			if depth > 0 {
+				err = enc.EncodeToken(t)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// isName reports whether s can be used as the local name of an element or
+// attribute.  The decoder is the judge, so that what is sent can be read back.
+func isName(s string) bool {
+	if s == "" || strings.ContainsAny(s, ":/>") {
+		return false
+	}
+	t, err := xml.NewDecoder(strings.NewReader("<" + s + "/>")).Token()
+	se, ok := t.(xml.StartElement)
+	return err == nil && ok && se.Name.Local == s && len(se.Attr) == 0
+}
@@ -0,0 +1,228 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// captureConn is a net.Conn that keeps what is written to it.
+type captureConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+// captureClient returns a Client whose writes go to the returned conn.
+func captureClient() (*Client, *captureConn) {
+	conn := new(captureConn)
+	return &Client{conn: conn, domain: "example.com"}, conn
+}
+
+// checkStanza fails t unless s is exactly one well-formed element named name,
+// with nothing but whitespace around it.
+func checkStanza(t *testing.T, s, name string) {
+	t.Helper()
+	d := xml.NewDecoder(strings.NewReader(s))
+	depth, top := 0, 0
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid XML %q: %v", s, err)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				top++
+				if tok.Name.Local != name {
+					t.Fatalf("top-level <%s> in %q, want <%s>", tok.Name.Local, s, name)
+				}
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth == 0 && len(bytes.TrimSpace(tok)) > 0 {
+				t.Fatalf("top-level text in %q", s)
+			}
+		default:
+			if depth == 0 {
+				t.Fatalf("top-level %T in %q", tok, s)
+			}
+		}
+	}
+	if top != 1 {
+		t.Fatalf("%d top-level elements in %q, want 1", top, s)
+	}
+}
+
+// checkSent checks what a send wrote: one <name/> stanza if it succeeded,
+// and nothing if it failed.
+func checkSent(t *testing.T, conn *captureConn, name string, err error) {
+	t.Helper()
+	if err != nil {
+		if conn.buf.Len() > 0 {
+			t.Fatalf("failed with %v, but wrote %q", err, conn.buf.String())
+		}
+		return
+	}
+	checkStanza(t, conn.buf.String(), name)
+}
+
+// Seeds shared by the fuzz tests: an address, some text, an element name and
+// raw XML.
+var fuzzSeeds = [][4]string{
+	{"juliet@example.com/balcony", "hello", "x", "<item jid='romeo@example.net'/>"},
+	{"a'\"<>&", "\x01</message><evil/>", "x", "]]>"},
+	{"</iq><iq>", "a\r\nb", "a b", "</iq><iq type='set'>"},
+	{"", "\ufffe\U0010ffff", "ns:x", "<a/></w><w><b/>"},
+	{"x", "<![CDATA[", "x", "<a xmlns:p='urn:p'><p:b p:c='d'/></a><!-- c --><?pi x?>"},
+	{"x", "text", "x", "<a>&amp;&#x1;</a>"},
+}
+
+func FuzzSend(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add(s[0], s[1], s[2], s[3])
+	}
+	f.Fuzz(func(t *testing.T, addr, text, name, raw string) {
+		c, conn := captureClient()
+		_, err := c.Send(Chat{
+			Remote:       addr,
+			Type:         text,
+			Text:         text,
+			ID:           addr,
+			Lang:         addr,
+			Subject:      text,
+			Bodies:       []Text{{Lang: addr, Text: text}},
+			Thread:       text,
+			ThreadParent: addr,
+			Extensions: []RawElement{{
+				XMLName:  xml.Name{Space: addr, Local: name},
+				Attr:     []xml.Attr{{Name: xml.Name{Local: name}, Value: text}},
+				InnerXML: raw,
+			}},
+		})
+		checkSent(t, conn, "message", err)
+	})
+}
+
+func FuzzSendPresence(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add(s[0], s[1], s[2], s[3])
+	}
+	f.Fuzz(func(t *testing.T, addr, text, name, raw string) {
+		c, conn := captureClient()
+		_, err := c.SendPresence(Presence{
+			From:     addr,
+			To:       addr,
+			Type:     text,
+			Show:     text,
+			ID:       addr,
+			Lang:     addr,
+			Statuses: []Text{{Lang: addr, Text: text}, {Text: text}},
+			Caps:     &Caps{Hash: text, Node: addr, Ver: text},
+			Error:    &StanzaError{Type: text, Condition: Condition(name), Text: text, Lang: addr, By: addr},
+			Extensions: []RawElement{{
+				XMLName:  xml.Name{Space: addr, Local: name},
+				Attr:     []xml.Attr{{Name: xml.Name{Space: "xmlns", Local: name}, Value: addr}},
+				InnerXML: raw,
+			}},
+		})
+		checkSent(t, conn, "presence", err)
+	})
+}
+
+func FuzzSendIQ(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add(s[0], s[1], s[2], s[3])
+	}
+	f.Fuzz(func(t *testing.T, addr, text, name, raw string) {
+		// No response will come; SendIQ returns once it has written.
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		c, conn := captureClient()
+		_, err := c.SendIQ(ctx, IQ{ID: addr, To: addr, Type: "set", Payload: raw})
+		if err == context.Canceled {
+			err = nil
+		}
+		checkSent(t, conn, "iq", err)
+
+		c, conn = captureClient()
+		err = c.SendIQResult(IQ{ID: addr, From: addr}, raw)
+		checkSent(t, conn, "iq", err)
+
+		c, conn = captureClient()
+		err = c.SendIQError(IQ{ID: addr, From: addr}, &StanzaError{Type: text, Condition: Condition(name), Text: text, Data: text})
+		checkSent(t, conn, "iq", err)
+	})
+}
+
+func FuzzSendXHTML(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add(s[0], s[1], s[3])
+	}
+	f.Add("x", "", "<p style='color: red' onclick='x'>a<script>b</script></p>")
+	f.Add("x", "", "</body><body>")
+	f.Fuzz(func(t *testing.T, addr, text, html string) {
+		c, conn := captureClient()
+		_, err := c.SendXHTML(Chat{Remote: addr, Type: "chat", Text: text}, html)
+		checkSent(t, conn, "message", err)
+
+		c, conn = captureClient()
+		_, err = c.SendHtml(Chat{Remote: addr, Text: html})
+		checkSent(t, conn, "message", err)
+	})
+}
+
+// FuzzPresenceHelpers fuzzes the methods that send a presence without
+// returning an error: they either send one whole stanza or nothing.
+func FuzzPresenceHelpers(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add(s[0], s[1])
+	}
+	f.Fuzz(func(t *testing.T, addr, text string) {
+		for _, send := range []func(c *Client){
+			func(c *Client) { c.JoinMUC(addr) },
+			func(c *Client) { c.LeaveMUC(addr) },
+			func(c *Client) { c.ChangeStatus(text, text) },
+		} {
+			c, conn := captureClient()
+			c.jid = addr
+			send(c)
+			if conn.buf.Len() > 0 {
+				checkStanza(t, conn.buf.String(), "presence")
+			}
+		}
+	})
+}
+
+func TestSendIQRejectsRawXML(t *testing.T) {
+	for _, raw := range []string{
+		"</iq><iq>",
+		"<a>",
+		"<a></b>",
+		"<a/></w><w><b/>",
+		"\x01",
+		"<a>&#x1;</a>",
+		"<a xmlns:p='urn:p'><p:0/></a>",
+		"<a xmlns:p='urn:p' p:0=''/>",
+	} {
+		if s, err := iqXML(IQ{ID: "1", Type: "set", Payload: raw}); err == nil {
+			t.Errorf("payload %q accepted: %s", raw, s)
+		}
+	}
+}
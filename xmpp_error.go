@@ -0,0 +1,256 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+)
+
+const (
+	nsStreams = "urn:ietf:params:xml:ns:xmpp-streams"
+	nsStanzas = "urn:ietf:params:xml:ns:xmpp-stanzas"
+)
+
+// Condition is a defined error condition: a stream error condition
+// (RFC 6120 4.9.3), a stanza error condition (RFC 6120 8.3.3) or a SASL
+// failure condition (RFC 6120 6.5).
+type Condition string
+
+// Stream error conditions, RFC 6120 4.9.3.
+const (
+	CondBadFormat              Condition = "bad-format"
+	CondBadNamespacePrefix     Condition = "bad-namespace-prefix"
+	CondConflict               Condition = "conflict"
+	CondConnectionTimeout      Condition = "connection-timeout"
+	CondHostGone               Condition = "host-gone"
+	CondHostUnknown            Condition = "host-unknown"
+	CondImproperAddressing     Condition = "improper-addressing"
+	CondInternalServerError    Condition = "internal-server-error"
+	CondInvalidFrom            Condition = "invalid-from"
+	CondInvalidNamespace       Condition = "invalid-namespace"
+	CondInvalidXML             Condition = "invalid-xml"
+	CondNotAuthorized          Condition = "not-authorized"
+	CondNotWellFormed          Condition = "not-well-formed"
+	CondPolicyViolation        Condition = "policy-violation"
+	CondRemoteConnectionFailed Condition = "remote-connection-failed"
+	CondReset                  Condition = "reset"
+	CondResourceConstraint     Condition = "resource-constraint"
+	CondRestrictedXML          Condition = "restricted-xml"
+	CondSeeOtherHost           Condition = "see-other-host"
+	CondSystemShutdown         Condition = "system-shutdown"
+	CondUndefinedCondition     Condition = "undefined-condition"
+	CondUnsupportedEncoding    Condition = "unsupported-encoding"
+	CondUnsupportedFeature     Condition = "unsupported-feature"
+	CondUnsupportedStanzaType  Condition = "unsupported-stanza-type"
+	CondUnsupportedVersion     Condition = "unsupported-version"
+)
+
+// Stanza error conditions, RFC 6120 8.3.3.  conflict, internal-server-error,
+// not-authorized, policy-violation, resource-constraint and
+// undefined-condition are shared with stream errors.
+const (
+	CondBadRequest            Condition = "bad-request"
+	CondFeatureNotImplemented Condition = "feature-not-implemented"
+	CondForbidden             Condition = "forbidden"
+	CondGone                  Condition = "gone"
+	CondItemNotFound          Condition = "item-not-found"
+	CondJIDMalformed          Condition = "jid-malformed"
+	CondNotAcceptable         Condition = "not-acceptable"
+	CondNotAllowed            Condition = "not-allowed"
+	CondRecipientUnavailable  Condition = "recipient-unavailable"
+	CondRedirect              Condition = "redirect"
+	CondRegistrationRequired  Condition = "registration-required"
+	CondRemoteServerNotFound  Condition = "remote-server-not-found"
+	CondRemoteServerTimeout   Condition = "remote-server-timeout"
+	CondServiceUnavailable    Condition = "service-unavailable"
+	CondSubscriptionRequired  Condition = "subscription-required"
+	CondUnexpectedRequest     Condition = "unexpected-request"
+)
+
+// SASL failure conditions, RFC 6120 6.5.  not-authorized is shared with
+// stream errors.
+const (
+	CondAborted              Condition = "aborted"
+	CondAccountDisabled      Condition = "account-disabled"
+	CondCredentialsExpired   Condition = "credentials-expired"
+	CondEncryptionRequired   Condition = "encryption-required"
+	CondIncorrectEncoding    Condition = "incorrect-encoding"
+	CondInvalidAuthzid       Condition = "invalid-authzid"
+	CondInvalidMechanism     Condition = "invalid-mechanism"
+	CondMalformedRequest     Condition = "malformed-request"
+	CondMechanismTooWeak     Condition = "mechanism-too-weak"
+	CondTemporaryAuthFailure Condition = "temporary-auth-failure"
+)
+
+// StreamError is a <stream:error/> sent by the server (RFC 6120 4.9).  Stream
+// errors are unrecoverable; the server closes the stream after sending one.
+type StreamError struct {
+	Condition   Condition
+	Data        string      // character data of the condition, such as the host of see-other-host
+	Text        string      // human readable description, if any
+	Lang        string      // language of Text
+	AppSpecific *RawElement // application specific condition, if any
+}
+
+func (e *StreamError) Error() string {
+	s := "xmpp: stream error: " + string(e.Condition)
+	if e.Text != "" {
+		s += ": " + e.Text
+	}
+	return s
+}
+
+func (e *StreamError) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var err error
+	e.Condition, e.Data, e.Text, e.Lang, e.AppSpecific, err = decodeCondition(d, start, nsStreams)
+	return err
+}
+
+// StanzaError is the <error/> child of a stanza of type 'error' (RFC 6120 8.3).
+type StanzaError struct {
+	Type        string // auth, cancel, continue, modify or wait
+	By          string // entity that returned the error, if given
+	Code        string // legacy numeric code, if given
+	Condition   Condition
+	Data        string      // character data of the condition, such as the URI of gone or redirect
+	Text        string      // human readable description, if any
+	Lang        string      // language of Text
+	AppSpecific *RawElement // application specific condition, if any
+}
+
+func (e *StanzaError) Error() string {
+	s := "xmpp: " + e.Type + " error: " + string(e.Condition)
+	if e.Text != "" {
+		s += ": " + e.Text
+	}
+	return s
+}
+
+// MarshalXML encodes e as the <error/> child of a stanza.
+func (e *StanzaError) MarshalXML(enc *xml.Encoder, _ xml.StartElement) error {
+	typ, cond := e.Type, e.Condition
+	if typ == "" {
+		typ = "cancel"
+	}
+	if !isName(string(cond)) {
+		cond = CondUndefinedCondition
+	}
+	start := xml.StartElement{Name: xml.Name{Local: "error"}, Attr: []xml.Attr{{Name: xml.Name{Local: "type"}, Value: typ}}}
+	if e.By != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "by"}, Value: e.By})
+	}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if err := encodeText(enc, xml.StartElement{Name: xml.Name{Space: nsStanzas, Local: string(cond)}}, e.Data); err != nil {
+		return err
+	}
+	if e.Text != "" {
+		text := xml.StartElement{Name: xml.Name{Space: nsStanzas, Local: "text"}}
+		if e.Lang != "" {
+			text.Attr = []xml.Attr{{Name: xml.Name{Space: nsXML, Local: "lang"}, Value: e.Lang}}
+		}
+		if err := encodeText(enc, text, e.Text); err != nil {
+			return err
+		}
+	}
+	if e.AppSpecific != nil {
+		if err := enc.Encode(e.AppSpecific); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// encodeText encodes the element start with s as its character data.
+func encodeText(enc *xml.Encoder, start xml.StartElement, s string) error {
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if s != "" {
+		if err := enc.EncodeToken(xml.CharData(s)); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+func (e *StanzaError) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for _, a := range start.Attr {
+		switch a.Name.Local {
+		case "type":
+			e.Type = a.Value
+		case "by":
+			e.By = a.Value
+		case "code":
+			e.Code = a.Value
+		}
+	}
+	var err error
+	e.Condition, e.Data, e.Text, e.Lang, e.AppSpecific, err = decodeCondition(d, start, nsStanzas)
+	return err
+}
+
+// AuthError is a SASL <failure/> (RFC 6120 6.5) returned when the server
+// refuses to authenticate the client.
+type AuthError struct {
+	Condition Condition
+	Text      string
+	Lang      string
+}
+
+func (e *AuthError) Error() string {
+	s := "auth failure: " + string(e.Condition)
+	if e.Text != "" {
+		s += ": " + e.Text
+	}
+	return s
+}
+
+func (e *AuthError) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var err error
+	e.Condition, _, e.Text, e.Lang, _, err = decodeCondition(d, start, nsSASL)
+	return err
+}
+
+type errorChild struct {
+	XMLName xml.Name
+	Attr    []xml.Attr `xml:",any,attr"`
+	Data    string     `xml:",chardata"`
+	Inner   string     `xml:",innerxml"`
+}
+
+// decodeCondition reads the children of an error element: the defined
+// condition and the text in ns, and anything else as an application specific
+// condition.  SASL2 failures carry the condition in ns and the text in their
+// own namespace, so <text/> is accepted in any namespace.
+func decodeCondition(d *xml.Decoder, start xml.StartElement, ns string) (cond Condition, data, text, lang string, app *RawElement, err error) {
+	var v struct {
+		Children []errorChild `xml:",any"`
+	}
+	if err = d.DecodeElement(&v, &start); err != nil {
+		return
+	}
+	for _, c := range v.Children {
+		switch {
+		case c.XMLName.Local == "text" && (c.XMLName.Space == ns || c.XMLName.Space == start.Name.Space):
+			text = c.Data
+			for _, a := range c.Attr {
+				if a.Name.Local == "lang" {
+					lang = a.Value
+				}
+			}
+		case c.XMLName.Space == ns && cond == "":
+			cond = Condition(c.XMLName.Local)
+			data = c.Data
+		case app == nil:
+			app = &RawElement{XMLName: c.XMLName, Attr: stripXMLNS(c.Attr), InnerXML: c.Inner}
+		}
+	}
+	if cond == "" {
+		cond = CondUndefinedCondition
+	}
+	return
+}
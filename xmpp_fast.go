@@ -0,0 +1,175 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const nsFAST = "urn:xmpp:fast:0"
+
+// FASTToken is a token issued by the server for Fast Authentication
+// Streamlining Tokens (XEP-0484).  It stands in for the password on later
+// logins from the same Options.UserAgentID.
+type FASTToken struct {
+	Mechanism string    // the HT-* mechanism the token is for, such as "HT-SHA-256-NONE"
+	Secret    string    // the token itself
+	Expiry    time.Time // zero if the server did not say
+	Count     uint64    // number of times the token has been used
+}
+
+// TokenStore persists FAST tokens between logins.  The key is Options.User.
+type TokenStore interface {
+	// LoadToken returns the stored token, or nil if there is none.
+	LoadToken(user string) (*FASTToken, error)
+
+	// StoreToken replaces the stored token; a nil t deletes it.
+	StoreToken(user string, t *FASTToken) error
+}
+
+// fastSessions lets TLS sessions be resumed when FAST is in use, which saves
+// a round trip of the TLS handshake.  crypto/tls does not send early data, so
+// FAST logins do not use TLS 0-RTT.
+var fastSessions = tls.NewLRUClientSessionCache(0)
+
+// fastAuthenticate logs in with the stored FAST token, if there is a usable
+// one.  It returns nil, nil if there is none.
+func (c *Client) fastAuthenticate(o *Options, auth *sasl2Authentication, info *SASLInfo) (*sasl2Success, error) {
+	tok, err := o.TokenStore.LoadToken(o.User)
+	if err != nil || tok == nil {
+		return nil, err
+	}
+	if !tok.Expiry.IsZero() && time.Now().After(tok.Expiry) {
+		return nil, nil
+	}
+	if !contains(auth.Inline.Fast.Mechanism, tok.Mechanism) {
+		return nil, nil
+	}
+	m := &htAuth{mech: tok.Mechanism, token: tok.Secret}
+	ir, err := m.Start(info)
+	if err == ErrMechanismUnavailable {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The count must grow with every use, even one that fails.
+	tok.Count++
+	if err = o.TokenStore.StoreToken(o.User, tok); err != nil {
+		return nil, err
+	}
+	extra := fmt.Sprintf("<fast xmlns='%s' count='%d'/>", nsFAST, tok.Count)
+	success, err := c.sasl2Exchange(o, auth, m, ir, extra)
+	if err != nil {
+		return nil, err
+	}
+	// The server may rotate the token.
+	if err = c.storeToken(o, tok.Mechanism, success.Token); err != nil {
+		return nil, err
+	}
+	return success, nil
+}
+
+// storeToken saves a token for mech issued in <success/>.
+func (c *Client) storeToken(o *Options, mech string, t *fastToken) error {
+	if t == nil || t.Token == "" {
+		return nil
+	}
+	tok := &FASTToken{Mechanism: mech, Secret: t.Token}
+	if t.Expiry != "" {
+		tok.Expiry, _ = time.Parse(time.RFC3339, t.Expiry)
+	}
+	return o.TokenStore.StoreToken(o.User, tok)
+}
+
+// fastMechanism picks the strongest HT-* mechanism offered by the server that
+// can be used on this connection, or "".
+func fastMechanism(offered []string, info *SASLInfo) string {
+	for _, m := range []string{"HT-SHA-256-EXPR", "HT-SHA-256-UNIQ", "HT-SHA-256-NONE"} {
+		if !contains(offered, m) {
+			continue
+		}
+		if _, ok := htChannelBinding(m, info); ok {
+			return m
+		}
+	}
+	return ""
+}
+
+// HT-SHA-256-*, the hashed token mechanisms of XEP-0484.
+type htAuth struct {
+	mech   string
+	token  string
+	cbData []byte
+}
+
+func (a *htAuth) Name() string { return a.mech }
+
+func (a *htAuth) Start(info *SASLInfo) ([]byte, error) {
+	cb, ok := htChannelBinding(a.mech, info)
+	if !ok {
+		return nil, ErrMechanismUnavailable
+	}
+	a.cbData = cb
+	return append([]byte(info.User+"\x00"), a.hmac("Initiator")...), nil
+}
+
+func (a *htAuth) Next(data []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, errors.New("xmpp: unexpected " + a.mech + " challenge")
+	}
+	if !hmac.Equal(data, a.hmac("Responder")) {
+		return nil, errors.New("xmpp: " + a.mech + " server response mismatch")
+	}
+	return nil, nil
+}
+
+func (a *htAuth) hmac(label string) []byte {
+	m := hmac.New(sha256.New, []byte(a.token))
+	m.Write([]byte(label))
+	m.Write(a.cbData)
+	return m.Sum(nil)
+}
+
+// htChannelBinding returns the channel binding data for an HT-* mechanism,
+// and whether it is available on this connection.
+func htChannelBinding(mech string, info *SASLInfo) ([]byte, bool) {
+	switch mech {
+	case "HT-SHA-256-NONE":
+		return nil, true
+	case "HT-SHA-256-EXPR":
+		if info.TLS == nil || info.TLS.Version < tls.VersionTLS13 {
+			return nil, false
+		}
+		b, err := info.TLS.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		return b, err == nil
+	case "HT-SHA-256-UNIQ":
+		if info.TLS == nil || len(info.TLS.TLSUnique) == 0 {
+			return nil, false
+		}
+		return info.TLS.TLSUnique, true
+	}
+	return nil, false
+}
+
+// XEP-0484  Fast Authentication Streamlining Tokens
+
+type fastFeature struct {
+	XMLName   xml.Name `xml:"urn:xmpp:fast:0 fast"`
+	Mechanism []string `xml:"mechanism"`
+}
+
+type fastToken struct {
+	XMLName xml.Name `xml:"urn:xmpp:fast:0 token"`
+	Expiry  string   `xml:"expiry,attr"`
+	Token   string   `xml:"token,attr"`
+}
@@ -0,0 +1,238 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultIQTimeout is how long SendIQ waits for a response when neither the
+// context nor Options.IQTimeout sets a limit.
+const DefaultIQTimeout = 30 * time.Second
+
+// ErrIQAborted is returned by SendIQ when the stream ends before the
+// response arrives.
+var ErrIQAborted = errors.New("xmpp: stream closed before <iq> response")
+
+// IQ is an info/query stanza (RFC 6120 8.2.3).
+type IQ struct {
+	ID      string
+	From    string
+	To      string
+	Type    string       // get, set, result or error
+	Payload string       // raw XML of the child elements
+	Error   *StanzaError // set if Type is "error"
+
+	// Payloads are the child elements decoded by type; see RegisterPayload.
+	// When sending, they are written after Payload.
+	Payloads []interface{}
+}
+
+// iqRequest is a SendIQ call waiting for its response.
+type iqRequest struct {
+	to string
+	ch chan IQ
+}
+
+// SendIQ sends iq, which must be of type get or set, and waits for the
+// response.  If iq.ID is empty one is generated.  A response of type error
+// is returned together with its *StanzaError.
+//
+// The response is picked out of the stream by Recv, so another goroutine
+// must be calling Recv while SendIQ waits.  If ctx has no deadline, the
+// wait is limited by Options.IQTimeout.
+func (c *Client) SendIQ(ctx context.Context, iq IQ) (IQ, error) {
+	if iq.Type != "get" && iq.Type != "set" {
+		return IQ{}, errors.New("xmpp: SendIQ needs an <iq> of type get or set, not " + iq.Type)
+	}
+	if iq.ID == "" {
+		iq.ID = fmt.Sprintf("%x", getCookie())
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		timeout := c.opts.IQTimeout
+		if timeout <= 0 {
+			timeout = DefaultIQTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	r := &iqRequest{to: iq.To, ch: make(chan IQ, 1)}
+	c.iqMu.Lock()
+	if c.iqs == nil {
+		c.iqs = make(map[string]*iqRequest)
+	}
+	if _, dup := c.iqs[iq.ID]; dup {
+		c.iqMu.Unlock()
+		return IQ{}, errors.New("xmpp: <iq> id already in use: " + iq.ID)
+	}
+	c.iqs[iq.ID] = r
+	c.iqMu.Unlock()
+	defer func() {
+		c.iqMu.Lock()
+		if c.iqs[iq.ID] == r {
+			delete(c.iqs, iq.ID)
+		}
+		c.iqMu.Unlock()
+	}()
+
+	s, err := iqXML(iq)
+	if err != nil {
+		return IQ{}, err
+	}
+	if _, err := c.writef("%s", s); err != nil {
+		return IQ{}, err
+	}
+
+	select {
+	case resp, ok := <-r.ch:
+		if !ok {
+			return IQ{}, ErrIQAborted
+		}
+		if resp.Type == "error" {
+			return resp, resp.Error
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return IQ{}, ctx.Err()
+	}
+}
+
+// deliverIQ hands a result or error to the SendIQ call waiting for it, and
+// reports whether there was one.
+func (c *Client) deliverIQ(iq IQ) bool {
+	c.iqMu.Lock()
+	defer c.iqMu.Unlock()
+	r, ok := c.iqs[iq.ID]
+	if !ok || !c.iqFromMatches(r.to, iq.From) {
+		return false
+	}
+	delete(c.iqs, iq.ID)
+	r.ch <- iq
+	return true
+}
+
+// abortIQs fails every pending SendIQ call, once the stream they were sent
+// on is gone.
+func (c *Client) abortIQs() {
+	c.iqMu.Lock()
+	defer c.iqMu.Unlock()
+	for id, r := range c.iqs {
+		close(r.ch)
+		delete(c.iqs, id)
+	}
+}
+
+// iqFromMatches reports whether a response from 'from' can answer a request
+// sent to 'to'.  Requests to the account or its server are answered by the
+// server (RFC 6120 10.3.3), which may use no 'from', the bare JID, the full
+// JID or the domain.
+func (c *Client) iqFromMatches(to, from string) bool {
+	return sameJID(to, from) || c.isServer(to) && c.isServer(from)
+}
+
+// isServer reports whether addr stands for our account or its server.
+func (c *Client) isServer(addr string) bool {
+	if addr == "" {
+		return true
+	}
+	j, err := ParseJID(addr)
+	if err != nil {
+		return false
+	}
+	me, _ := ParseJID(c.jid)
+	return j == me || j == me.Bare() || j.Local() == "" && j.IsBare() && j.asciiDomain() == c.domain
+}
+
+// sameJID reports whether a and b are the same address once normalized.
+func sameJID(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ja, err := ParseJID(a)
+	if err != nil {
+		return false
+	}
+	jb, err := ParseJID(b)
+	return err == nil && ja == jb
+}
+
+// syncIQ sends iq and reads the stream until its response arrives.  It is used
+// while logging in, before anyone calls Recv; anything else that arrives in
+// the meantime is dropped.
+func (c *Client) syncIQ(iq IQ) (*clientIQ, error) {
+	s, err := iqXML(iq)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.write(s, true); err != nil {
+		return nil, err
+	}
+	for {
+		_, val, err := next(c.p)
+		if err != nil {
+			return nil, err
+		}
+		if c.smInbound(val) {
+			continue
+		}
+		switch v := val.(type) {
+		case *clientIQ:
+			if v.Id == iq.ID && (v.Type == "result" || v.Type == "error") && c.iqFromMatches(iq.To, v.From) {
+				return v, nil
+			}
+		case *StreamError:
+			return nil, v
+		}
+	}
+}
+
+// SendIQResult answers req, an <iq/> of type get or set, with a result
+// carrying payload, which may be empty.
+func (c *Client) SendIQResult(req IQ, payload string) error {
+	s, err := iqXML(IQ{Type: "result", ID: req.ID, To: req.From, Payload: payload})
+	if err != nil {
+		return err
+	}
+	_, err = c.writef("%s", s)
+	return err
+}
+
+// SendIQError answers req, an <iq/> of type get or set, with the stanza
+// error e.
+func (c *Client) SendIQError(req IQ, e *StanzaError) error {
+	s, err := iqXML(IQ{Type: "error", ID: req.ID, To: req.From, Error: e})
+	if err != nil {
+		return err
+	}
+	_, err = c.writef("%s", s)
+	return err
+}
+
+func iqXML(iq IQ) (string, error) {
+	out := outIQ{ID: iq.ID, To: iq.To, Type: iq.Type, Payload: rawXML(iq.Payload)}
+	if iq.Type == "error" {
+		out.Error = iq.Error
+	}
+	var err error
+	if out.Raw, err = marshalPayloads(iq.Payloads); err != nil {
+		return "", err
+	}
+	return encode(out)
+}
+
+// iq converts the decoded stanza to the IQ returned to users.
+func (v *clientIQ) iq() IQ {
+	iq := IQ{ID: v.Id, From: v.From, To: v.To, Type: v.Type, Payload: v.Payload, Error: v.Error}
+	iq.Payloads, _ = decodePayloads(rawElements(v.Payload))
+	if iq.Type == "error" && iq.Error == nil {
+		iq.Error = &StanzaError{Type: "cancel", Condition: CondUndefinedCondition}
+	}
+	return iq
+}
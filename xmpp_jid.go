@@ -0,0 +1,156 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/secure/precis"
+)
+
+// JID is an XMPP address (RFC 7622): an optional localpart, a domainpart and
+// an optional resourcepart, as in "juliet@example.com/balcony".  The parts
+// are kept in their normalized form, so JIDs can be compared with ==.
+type JID struct {
+	local    string
+	domain   string
+	resource string
+}
+
+// ParseJID parses and normalizes s.  The localpart is prepared with the
+// UsernameCaseMapped PRECIS profile, the domainpart with IDNA2008 and the
+// resourcepart with the OpaqueString PRECIS profile.
+func ParseJID(s string) (JID, error) {
+	var j JID
+	rest := s
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		rest, j.resource = rest[:i], rest[i+1:]
+		if j.resource == "" {
+			return JID{}, errors.New("xmpp: empty resourcepart in JID " + s)
+		}
+	}
+	if i := strings.IndexByte(rest, '@'); i >= 0 {
+		j.local, rest = rest[:i], rest[i+1:]
+		if j.local == "" {
+			return JID{}, errors.New("xmpp: empty localpart in JID " + s)
+		}
+	}
+
+	var err error
+	if j.domain, err = prepareDomain(rest); err != nil {
+		return JID{}, errors.New("xmpp: invalid domainpart in JID " + s + ": " + err.Error())
+	}
+	if j.local != "" {
+		if j.local, err = precis.UsernameCaseMapped.String(j.local); err != nil {
+			return JID{}, errors.New("xmpp: invalid localpart in JID " + s + ": " + err.Error())
+		}
+		if strings.ContainsAny(j.local, "\"&'/:<>@") {
+			return JID{}, errors.New("xmpp: invalid character in localpart of JID " + s)
+		}
+	}
+	if j.resource != "" {
+		if j.resource, err = precis.OpaqueString.String(j.resource); err != nil {
+			return JID{}, errors.New("xmpp: invalid resourcepart in JID " + s + ": " + err.Error())
+		}
+	}
+	for _, p := range []string{j.local, j.domain, j.resource} {
+		if len(p) > 1023 {
+			return JID{}, errors.New("xmpp: JID part longer than 1023 bytes in " + s)
+		}
+	}
+	return j, nil
+}
+
+// prepareDomain normalizes a domainpart to IDNA2008 U-labels (RFC 7622
+// 3.2), leaving IP literals alone.
+func prepareDomain(d string) (string, error) {
+	d = strings.TrimSuffix(d, ".")
+	if d == "" {
+		return "", errors.New("empty")
+	}
+	if strings.HasPrefix(d, "[") && strings.HasSuffix(d, "]") {
+		if net.ParseIP(d[1:len(d)-1]) == nil {
+			return "", errors.New("bad IPv6 literal")
+		}
+		return d, nil
+	}
+	if net.ParseIP(d) != nil {
+		return d, nil
+	}
+	if !utf8.ValidString(d) {
+		return "", errors.New("not UTF-8")
+	}
+	return idna.Lookup.ToUnicode(d)
+}
+
+// asciiDomain returns the domain of j as A-labels, as used by DNS and TLS.
+func (j JID) asciiDomain() string {
+	if a, err := idna.Lookup.ToASCII(j.domain); err == nil {
+		return a
+	}
+	return j.domain
+}
+
+// Local returns the localpart, which may be empty.
+func (j JID) Local() string {
+	return j.local
+}
+
+// Domain returns the domainpart.
+func (j JID) Domain() string {
+	return j.domain
+}
+
+// Resource returns the resourcepart, which may be empty.
+func (j JID) Resource() string {
+	return j.resource
+}
+
+// Bare returns j without its resourcepart.
+func (j JID) Bare() JID {
+	j.resource = ""
+	return j
+}
+
+// IsBare reports whether j has no resourcepart.
+func (j JID) IsBare() bool {
+	return j.resource == ""
+}
+
+// Equal reports whether j and o are the same address.
+func (j JID) Equal(o JID) bool {
+	return j == o
+}
+
+// String returns j in its normalized string form.
+func (j JID) String() string {
+	s := j.domain
+	if j.local != "" {
+		s = j.local + "@" + s
+	}
+	if j.resource != "" {
+		s += "/" + j.resource
+	}
+	return s
+}
+
+// parseJID returns s parsed, or the zero JID if s is not a valid JID.
+func parseJID(s string) JID {
+	j, _ := ParseJID(s)
+	return j
+}
+
+// jidString returns s, or j as a string if s is empty, for the address
+// fields of a stanza that have both forms.
+func jidString(s string, j JID) string {
+	if s != "" || j == (JID{}) {
+		return s
+	}
+	return j.String()
+}
@@ -0,0 +1,139 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseJID(t *testing.T) {
+	tests := []struct {
+		in                      string
+		local, domain, resource string
+	}{
+		{"juliet@example.com/balcony", "juliet", "example.com", "balcony"},
+		{"example.com", "", "example.com", ""},
+		{"example.com.", "", "example.com", ""},
+		{"juliet@example.com", "juliet", "example.com", ""},
+		{"example.com/foo", "", "example.com", "foo"},
+
+		// The localpart and domainpart are case-mapped, the resourcepart is not.
+		{"Juliet@Example.COM/Balcony", "juliet", "example.com", "Balcony"},
+		{"ΣΑΣ@example.com/ΣΑΣ", "σασ", "example.com", "ΣΑΣ"},
+
+		// Domains are kept as U-labels.
+		{"juliet@xn--bcher-kva.example/x", "juliet", "bücher.example", "x"},
+		{"juliet@BÜCHER.example", "juliet", "bücher.example", ""},
+
+		// Only the first slash ends the domainpart; the resourcepart may
+		// contain anything.
+		{"juliet@example.com/foo/bar", "juliet", "example.com", "foo/bar"},
+		{"juliet@example.com/foo@bar", "juliet", "example.com", "foo@bar"},
+		{"example.com/juliet@example.net", "", "example.com", "juliet@example.net"},
+		{"juliet@example.com/ a b ", "juliet", "example.com", " a b "},
+
+		// IP literals.
+		{"juliet@192.0.2.1/x", "juliet", "192.0.2.1", "x"},
+		{"juliet@[::1]/x", "juliet", "[::1]", "x"},
+		{"[2001:db8::1]", "", "[2001:db8::1]", ""},
+	}
+	for _, tt := range tests {
+		j, err := ParseJID(tt.in)
+		if err != nil {
+			t.Errorf("ParseJID(%q): %v", tt.in, err)
+			continue
+		}
+		if j.Local() != tt.local || j.Domain() != tt.domain || j.Resource() != tt.resource {
+			t.Errorf("ParseJID(%q) = %q, %q, %q; want %q, %q, %q", tt.in,
+				j.Local(), j.Domain(), j.Resource(), tt.local, tt.domain, tt.resource)
+		}
+	}
+}
+
+func TestParseJIDInvalid(t *testing.T) {
+	long := strings.Repeat("a", 1024)
+	for _, s := range []string{
+		"",
+		"@example.com",
+		"juliet@example.com/",
+		"@example.com/",
+		"juliet@",
+		"juliet@/x",
+		"/x",
+		"jul\"iet@example.com",
+		"jul'iet@example.com",
+		"jul<iet@example.com",
+		"jul>iet@example.com",
+		"jul&iet@example.com",
+		"jul:iet@example.com",
+		"jul iet@example.com",
+		"juliet@exa mple.com",
+		"juliet@example.com/\x07",
+		"juliet@[::1",
+		"juliet@[example.com]",
+		"juliet@\xff.example",
+		long + "@example.com",
+		"juliet@example.com/" + long,
+	} {
+		if j, err := ParseJID(s); err == nil {
+			t.Errorf("ParseJID(%q) = %q, want an error", s, j)
+		}
+	}
+	for _, s := range []string{
+		strings.Repeat("a", 1023) + "@example.com",
+		"juliet@example.com/" + strings.Repeat("a", 1023),
+	} {
+		if _, err := ParseJID(s); err != nil {
+			t.Errorf("ParseJID with a 1023-byte part: %v", err)
+		}
+	}
+}
+
+func TestJIDString(t *testing.T) {
+	for _, s := range []string{
+		"juliet@example.com/balcony",
+		"juliet@example.com",
+		"example.com/foo/bar",
+		"example.com",
+		"juliet@[::1]/x",
+	} {
+		if got := parseJID(s).String(); got != s {
+			t.Errorf("ParseJID(%q).String() = %q", s, got)
+		}
+	}
+}
+
+func TestJIDBareEqual(t *testing.T) {
+	full := parseJID("Juliet@Example.com/balcony")
+	bare := full.Bare()
+	if !bare.IsBare() || full.IsBare() {
+		t.Errorf("IsBare: %q is %v, %q is %v", bare, bare.IsBare(), full, full.IsBare())
+	}
+	if bare.String() != "juliet@example.com" {
+		t.Errorf("Bare() = %q, want juliet@example.com", bare)
+	}
+	if full.Resource() != "balcony" {
+		t.Errorf("Bare changed the resourcepart of its receiver to %q", full.Resource())
+	}
+
+	tests := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"juliet@example.com/balcony", "JULIET@EXAMPLE.COM/balcony", true},
+		{"juliet@example.com/balcony", "juliet@example.com./balcony", true},
+		{"juliet@bücher.example", "juliet@xn--bcher-kva.example", true},
+		{"juliet@example.com/balcony", "juliet@example.com/Balcony", false},
+		{"juliet@example.com/balcony", "juliet@example.com", false},
+		{"juliet@example.com", "romeo@example.com", false},
+		{"example.com", "juliet@example.com", false},
+	}
+	for _, tt := range tests {
+		if got := parseJID(tt.a).Equal(parseJID(tt.b)); got != tt.equal {
+			t.Errorf("%q.Equal(%q) = %v, want %v", tt.a, tt.b, got, tt.equal)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+const nsXML = "http://www.w3.org/XML/1998/namespace"
+
+// Text is human readable text in a given language, such as one of the
+// bodies of a message.
+type Text struct {
+	Lang string // xml:lang, empty for the language of the stanza
+	Text string
+}
+
+// chat converts the decoded stanza to a Chat.
+func (m *clientMessage) chat() Chat {
+	chat := Chat{
+		Remote:       m.From,
+		Type:         m.Type,
+		Error:        m.Error,
+		ID:           m.Id,
+		To:           m.To,
+		Lang:         m.Lang,
+		Thread:       m.Thread.ID,
+		ThreadParent: m.Thread.Parent,
+		RemoteJID:    parseJID(m.From),
+		ToJID:        parseJID(m.To),
+	}
+	chat.Bodies, chat.Text = texts(m.Body, m.Lang)
+	chat.Subjects, chat.Subject = texts(m.Subject, m.Lang)
+	var other []RawElement
+	for _, e := range m.Other {
+		e.Attr = stripXMLNS(e.Attr)
+		chat.Other = append(chat.Other, e.chardata())
+		if e.XMLName.Space == nsXHTMLIM && e.XMLName.Local == "html" && chat.HTML == nil {
+			if chat.HTML = parseXHTMLIM(e, m.Lang); chat.HTML != nil {
+				continue
+			}
+		}
+		other = append(other, e)
+	}
+	chat.Payloads, chat.Extensions = decodePayloads(other)
+	return chat
+}
+
+// texts converts the <body/> or <subject/> elements of a stanza in language
+// lang, and picks the one in that language, or else the first one.
+func texts(ct []clientText, lang string) (all []Text, text string) {
+	for _, t := range ct {
+		all = append(all, Text{Lang: t.Lang, Text: t.Body})
+	}
+	for _, t := range all {
+		if t.Lang == "" || t.Lang == lang {
+			return all, t.Text
+		}
+	}
+	if len(all) > 0 {
+		text = all[0].Text
+	}
+	return all, text
+}
+
+// xml returns chat as a message stanza.
+func (chat Chat) xml() (string, error) {
+	m := outMessage{
+		ID:         chat.ID,
+		To:         jidString(chat.Remote, chat.RemoteJID),
+		Type:       chat.Type,
+		Lang:       chat.Lang,
+		Subject:    outTexts(chat.Subject, chat.Subjects),
+		Body:       outTexts(chat.Text, chat.Bodies),
+		HTML:       chat.HTML,
+		Extensions: chat.Extensions,
+	}
+	if m.Lang == "" {
+		m.Lang = "en"
+	}
+	if chat.Thread != "" {
+		m.Thread = &outThread{Parent: chat.ThreadParent, ID: chat.Thread}
+	}
+	var err error
+	if m.Raw, err = marshalPayloads(chat.Payloads); err != nil {
+		return "", err
+	}
+	return encode(m)
+}
+
+// stripXMLNS drops the default namespace declaration from attr, which
+// XMLName.Space already holds.  Prefixed declarations are kept, as the inner
+// XML may use them.
+func stripXMLNS(attr []xml.Attr) []xml.Attr {
+	var out []xml.Attr
+	for _, a := range attr {
+		if a.Name.Space == "" && a.Name.Local == "xmlns" {
+			continue
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+// chardata returns the character data within e, at any depth.
+func (e *RawElement) chardata() string {
+	var b strings.Builder
+	d := xml.NewDecoder(strings.NewReader(e.InnerXML))
+	d.Strict = false
+	for {
+		t, err := d.Token()
+		if err != nil {
+			break
+		}
+		if cd, ok := t.(xml.CharData); ok {
+			b.Write(cd)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,194 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// Mux routes incoming stanzas to handlers registered by stanza kind, type
+// attribute and payload, in place of a loop around Recv.  See Client.Serve.
+//
+// A pattern is a payload namespace, such as "urn:xmpp:ping", optionally
+// followed by a space and a local name, such as "jabber:client body".  A
+// stanza matches if one of its child elements does; "" matches every stanza.
+// A typ of "" matches every type.  Messages without a type attribute have the
+// type "normal" and presences without one the type "available".
+//
+// When several handlers match, the one with the most specific pattern wins,
+// and of those the one registered first.  Handlers are called one at a time,
+// in the order the stanzas arrive, from the goroutine running Serve; since
+// SendIQ relies on Serve to read the response, a handler must call it from a
+// goroutine of its own.
+type Mux struct {
+	iq       []muxEntry
+	message  []muxEntry
+	presence []muxEntry
+}
+
+type muxEntry struct {
+	typ   string
+	space string
+	local string
+	fn    interface{}
+}
+
+// NewMux returns an empty Mux.
+func NewMux() *Mux {
+	return new(Mux)
+}
+
+// HandleIQ registers fn for <iq/> stanzas of type typ that match pattern.
+// A get or set no handler matches is answered with service-unavailable, as
+// RFC 6120 8.4 requires, except for pings (XEP-0199), which are answered with
+// a result; fn is expected to answer the ones it receives with SendIQResult or
+// SendIQError.
+func (m *Mux) HandleIQ(typ, pattern string, fn func(c *Client, iq IQ)) {
+	m.iq = append(m.iq, newMuxEntry(typ, pattern, fn))
+}
+
+// HandleMessage registers fn for <message/> stanzas of type typ that match
+// pattern.
+func (m *Mux) HandleMessage(typ, pattern string, fn func(c *Client, chat Chat)) {
+	m.message = append(m.message, newMuxEntry(typ, pattern, fn))
+}
+
+// HandlePresence registers fn for <presence/> stanzas of type typ that match
+// pattern.
+func (m *Mux) HandlePresence(typ, pattern string, fn func(c *Client, p Presence)) {
+	m.presence = append(m.presence, newMuxEntry(typ, pattern, fn))
+}
+
+func newMuxEntry(typ, pattern string, fn interface{}) muxEntry {
+	e := muxEntry{typ: typ, fn: fn}
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		e.space, e.local = pattern[:i], pattern[i+1:]
+	} else {
+		e.space = pattern
+	}
+	return e
+}
+
+// match returns the handler for a stanza of type typ with the given
+// children, or nil.
+func match(entries []muxEntry, typ string, payload []xml.Name) interface{} {
+	var fn interface{}
+	best := -1
+	for _, e := range entries {
+		if e.typ != "" && e.typ != typ {
+			continue
+		}
+		score := -1
+		switch {
+		case e.space == "":
+			score = 0
+		case e.local == "":
+			if hasPayload(payload, e.space, "") {
+				score = 1
+			}
+		default:
+			if hasPayload(payload, e.space, e.local) {
+				score = 2
+			}
+		}
+		if score > best {
+			fn, best = e.fn, score
+		}
+	}
+	return fn
+}
+
+func hasPayload(payload []xml.Name, space, local string) bool {
+	for _, n := range payload {
+		if n.Space == space && (local == "" || n.Local == local) {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve reads stanzas from the stream and dispatches them to mux until the
+// stream fails or ctx is done, and returns why.  Serve takes the place of
+// Recv; while it runs Recv returns ErrConcurrentRecv.  Like RecvContext, Serve
+// leaves the stream intact when ctx is done.  Unknown top-level elements are
+// dropped, unless Options.StrictParsing makes them fail the stream.
+func (c *Client) Serve(ctx context.Context, mux *Mux) error {
+	if !atomic.CompareAndSwapInt32(&c.reading, 0, 1) {
+		return ErrConcurrentRecv
+	}
+	defer atomic.StoreInt32(&c.reading, 0)
+
+	for {
+		event, payload, err := c.recvContext(ctx)
+		if err != nil {
+			return err
+		}
+		switch v := event.(type) {
+		case IQ:
+			fn, _ := match(mux.iq, v.Type, payload).(func(*Client, IQ))
+			if fn != nil {
+				fn(c, v)
+			} else if isPing(v) {
+				err = c.SendIQResult(v, "")
+			} else if v.Type == "get" || v.Type == "set" {
+				err = c.SendIQError(v, &StanzaError{Type: "cancel", Condition: CondServiceUnavailable})
+			}
+		case Chat:
+			typ := v.Type
+			if typ == "" {
+				typ = "normal"
+			}
+			if fn, _ := match(mux.message, typ, payload).(func(*Client, Chat)); fn != nil {
+				fn(c, v)
+			}
+		case Presence:
+			typ := v.Type
+			if typ == "" {
+				typ = "available"
+			}
+			if fn, _ := match(mux.presence, typ, payload).(func(*Client, Presence)); fn != nil {
+				fn(c, v)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// payloadNames returns the names of the top level elements in inner, the
+// inner XML of a stanza.  Elements that do not declare a namespace are in
+// jabber:client.
+func payloadNames(inner string) []xml.Name {
+	var names []xml.Name
+	d := xml.NewDecoder(strings.NewReader(inner))
+	depth := 0
+	for {
+		t, err := d.Token()
+		if err != nil {
+			if err != io.EOF {
+				return names
+			}
+			break
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				if t.Name.Space == "" {
+					t.Name.Space = nsClient
+				}
+				names = append(names, t.Name)
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return names
+}
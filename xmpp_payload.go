@@ -0,0 +1,84 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+	"sync"
+)
+
+var (
+	payloadMu sync.RWMutex
+	payloads  = map[xml.Name]func() interface{}{}
+)
+
+// RegisterPayload registers a Go type for the child elements of stanzas named
+// local in namespace space, or for all of them in space if local is "".  fn
+// returns a pointer to a new value to decode such an element into with
+// encoding/xml, such as
+//
+//	xmpp.RegisterPayload("urn:xmpp:receipts", "received", func() interface{} { return new(Received) })
+//
+// Recv then puts the decoded values in the Payloads of Chat, Presence and IQ,
+// in the order of the elements; elements that match no registration, or fail
+// to decode, are left in Extensions.  Payloads set when sending are encoded
+// with xml.Marshal, so the types should carry their XMLName.
+//
+// RegisterPayload is meant to be called from the init function of the
+// package that defines the type.  A later registration for the same name
+// replaces an earlier one.
+func RegisterPayload(space, local string, fn func() interface{}) {
+	payloadMu.Lock()
+	defer payloadMu.Unlock()
+	payloads[xml.Name{Space: space, Local: local}] = fn
+}
+
+// lookupPayload returns the registered constructor for elements named n.
+func lookupPayload(n xml.Name) func() interface{} {
+	payloadMu.RLock()
+	defer payloadMu.RUnlock()
+	if fn, ok := payloads[n]; ok {
+		return fn
+	}
+	return payloads[xml.Name{Space: n.Space}]
+}
+
+// decodePayloads decodes the elements of raw that have a registered type,
+// and returns them along with the rest.
+func decodePayloads(raw []RawElement) (decoded []interface{}, rest []RawElement) {
+	for _, e := range raw {
+		if fn := lookupPayload(e.XMLName); fn != nil {
+			v := fn()
+			if out, err := xml.Marshal(e); err == nil && xml.Unmarshal(out, v) == nil {
+				decoded = append(decoded, v)
+				continue
+			}
+		}
+		rest = append(rest, e)
+	}
+	return decoded, rest
+}
+
+// rawElements splits inner, the inner XML of a stanza, into its top level
+// elements.
+func rawElements(inner string) []RawElement {
+	var raw []RawElement
+	d := xml.NewDecoder(strings.NewReader(inner))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return raw
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			var e RawElement
+			if d.DecodeElement(&e, &se) != nil {
+				return raw
+			}
+			e.Attr = stripXMLNS(e.Attr)
+			raw = append(raw, e)
+		}
+	}
+}
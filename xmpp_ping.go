@@ -0,0 +1,75 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"context"
+	"time"
+)
+
+const nsPing = "urn:xmpp:ping"
+
+// Ping sends an XMPP Ping (XEP-0199) to jid, or to the server if jid is
+// empty, and returns the round trip time.  An entity that does not support
+// pings answers with a *StanzaError, which is returned along with the round
+// trip time.  Like SendIQ, Ping needs Recv or Serve to be running.
+func (c *Client) Ping(ctx context.Context, jid string) (time.Duration, error) {
+	if jid == "" {
+		jid = c.domain
+	}
+	start := time.Now()
+	_, err := c.SendIQ(ctx, IQ{Type: "get", To: jid, Payload: "<ping xmlns='" + nsPing + "'/>"})
+	rtt := time.Since(start)
+	if _, ok := err.(*StanzaError); err != nil && !ok {
+		return 0, err
+	}
+	return rtt, err
+}
+
+// keepAlive writes to the stream every o.KeepAliveInterval until the client
+// is closed, and closes the connection when the server no longer answers,
+// which makes Recv fail.
+func (c *Client) keepAlive(o *Options) {
+	t := time.NewTicker(o.KeepAliveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+
+		c.sendMu.Lock()
+		conn := c.conn
+		c.sendMu.Unlock()
+		var err error
+		if o.KeepAlivePing {
+			timeout := o.KeepAliveTimeout
+			if timeout <= 0 {
+				timeout = o.KeepAliveInterval
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			_, err = c.Ping(ctx, "")
+			cancel()
+			if _, ok := err.(*StanzaError); ok {
+				// An answer, even an error, means the server is there.
+				err = nil
+			}
+		} else {
+			c.sendMu.Lock()
+			_, err = c.write(" ", false)
+			c.sendMu.Unlock()
+		}
+		if err != nil && !c.replacing(conn) {
+			c.Close()
+			return
+		}
+	}
+}
+
+// isPing reports whether iq is a ping request.
+func isPing(iq IQ) bool {
+	return iq.Type == "get" && hasPayload(payloadNames(iq.Payload), nsPing, "ping")
+}
@@ -0,0 +1,128 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"strconv"
+	"strings"
+)
+
+// MUCUser is the occupant information a room (XEP-0045) adds to the
+// presence of its occupants.
+type MUCUser struct {
+	Affiliation string // owner, admin, member, outcast or none
+	Role        string // moderator, participant, visitor or none
+	JID         string // real JID of the occupant, if the room discloses it
+	Nick        string // new nickname, on a nickname change
+	Codes       []int  // status codes, such as 110 for our own presence
+}
+
+// Caps is the entity capabilities (XEP-0115) advertised in a presence.
+type Caps struct {
+	Hash string // hash function of Ver, such as "sha-1"
+	Node string // URI of the software
+	Ver  string // verification string
+}
+
+// SendPresence sends p.  A presence without a recipient and of no type, a
+// broadcast of our availability, is sent again by ReconnectingClient after a
+// reconnection; one of type unavailable cancels that.
+func (c *Client) SendPresence(p Presence) (n int, err error) {
+	s, err := p.xml()
+	if err != nil {
+		return 0, err
+	}
+	if jidString(p.To, p.ToJID) == "" {
+		c.stateMu.Lock()
+		switch p.Type {
+		case "":
+			c.presence = &p
+		case "unavailable":
+			c.presence = nil
+		}
+		c.stateMu.Unlock()
+	}
+	return c.writef("%s", s)
+}
+
+// presence converts the decoded stanza to a Presence.
+func (v *clientPresence) presence() Presence {
+	p := Presence{
+		From:    v.From,
+		To:      v.To,
+		Type:    v.Type,
+		Show:    strings.TrimSpace(v.Show),
+		Error:   v.Error,
+		ID:      v.Id,
+		Lang:    v.Lang,
+		FromJID: parseJID(v.From),
+		ToJID:   parseJID(v.To),
+	}
+	p.Statuses, p.Status = texts(v.Status, v.Lang)
+	p.Priority, _ = strconv.Atoi(strings.TrimSpace(v.Priority))
+	if u := v.MUCUser; u != nil {
+		p.MUCUser = &MUCUser{
+			Affiliation: u.Item.Affiliation,
+			Role:        u.Item.Role,
+			JID:         u.Item.JID,
+			Nick:        u.Item.Nick,
+		}
+		for _, s := range u.Status {
+			p.MUCUser.Codes = append(p.MUCUser.Codes, s.Code)
+		}
+	}
+	if v.Caps != nil {
+		p.Caps = &Caps{Hash: v.Caps.Hash, Node: v.Caps.Node, Ver: v.Caps.Ver}
+	}
+	for i := range v.Other {
+		v.Other[i].Attr = stripXMLNS(v.Other[i].Attr)
+	}
+	p.Payloads, p.Extensions = decodePayloads(v.Other)
+	return p
+}
+
+// xml returns p as a presence stanza.
+func (p Presence) xml() (string, error) {
+	out := outPresence{
+		ID:         p.ID,
+		From:       jidString(p.From, p.FromJID),
+		To:         jidString(p.To, p.ToJID),
+		Type:       p.Type,
+		Lang:       p.Lang,
+		Show:       p.Show,
+		Status:     outTexts(p.Status, p.Statuses),
+		Priority:   p.Priority,
+		Extensions: p.Extensions,
+		Error:      p.Error,
+	}
+	if c := p.Caps; c != nil {
+		out.Caps = &outCaps{Hash: c.Hash, Node: c.Node, Ver: c.Ver}
+	}
+	var err error
+	if out.Raw, err = marshalPayloads(p.Payloads); err != nil {
+		return "", err
+	}
+	return encode(out)
+}
+
+// XEP-0045  Multi-User Chat
+type clientMUCUser struct {
+	Item struct {
+		Affiliation string `xml:"affiliation,attr"`
+		Role        string `xml:"role,attr"`
+		JID         string `xml:"jid,attr"`
+		Nick        string `xml:"nick,attr"`
+	} `xml:"item"`
+	Status []struct {
+		Code int `xml:"code,attr"`
+	} `xml:"status"`
+}
+
+// XEP-0115  Entity Capabilities
+type clientCaps struct {
+	Hash string `xml:"hash,attr"`
+	Node string `xml:"node,attr"`
+	Ver  string `xml:"ver,attr"`
+}
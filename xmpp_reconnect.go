@@ -0,0 +1,268 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrClientClosed is returned by a ReconnectingClient after Close.
+var ErrClientClosed = errors.New("xmpp: client closed")
+
+// ReconnectingClient wraps a Client and replaces it with a new one when the
+// stream fails.  The reconnection happens within Recv, RecvContext or Serve:
+// the new client logs in with the same Options, joins again the rooms joined
+// with JoinMUC and sends again the last presence set with SendPresence or
+// ChangeStatus.
+//
+// With Options.StreamManagement the new client resumes the stream instead
+// when the server allows it, which keeps rooms and presence as they were.
+// Either way, stanzas the server had not acknowledged are sent again.
+//
+// Attempts are spaced by an exponential backoff with jitter.  A failure to
+// authenticate (*AuthError) stops the attempts and is returned to the caller.
+type ReconnectingClient struct {
+	Options Options
+
+	// MinBackoff and MaxBackoff bound the delay between attempts to reconnect.
+	// Zero means one second and five minutes.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnDisconnect, if set, is called with the error that ended the stream.
+	OnDisconnect func(err error)
+
+	// OnReconnect, if set, is called with the new client once it has logged in.
+	OnReconnect func(c *Client)
+
+	mu     sync.Mutex
+	c      *Client
+	closed bool
+	done   chan struct{} // closed by Close
+}
+
+// NewReconnectingClient connects like NewClient and returns the client
+// wrapped in a ReconnectingClient.
+func (o Options) NewReconnectingClient() (*ReconnectingClient, error) {
+	c, err := o.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	return &ReconnectingClient{Options: o, c: c, done: make(chan struct{})}, nil
+}
+
+// Client returns the current client.  Sending on it fails while the stream
+// is down.
+func (r *ReconnectingClient) Client() *Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.c
+}
+
+// Close closes the current client and stops reconnecting, including an
+// attempt under way.
+func (r *ReconnectingClient) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.closed {
+		r.closed = true
+		close(r.done)
+	}
+	return r.c.Close()
+}
+
+// Recv is Client.Recv, reconnecting when the stream fails.
+func (r *ReconnectingClient) Recv() (event interface{}, err error) {
+	return r.RecvContext(context.Background())
+}
+
+// RecvContext is Client.RecvContext, reconnecting when the stream fails.
+func (r *ReconnectingClient) RecvContext(ctx context.Context) (event interface{}, err error) {
+	for {
+		c := r.Client()
+		event, err = c.RecvContext(ctx)
+		if err == nil || err == ErrConcurrentRecv || ctx.Err() != nil {
+			return event, err
+		}
+		if err = r.reconnect(ctx, c, err); err != nil {
+			return Chat{}, err
+		}
+	}
+}
+
+// Serve is Client.Serve, reconnecting when the stream fails.
+func (r *ReconnectingClient) Serve(ctx context.Context, mux *Mux) error {
+	for {
+		c := r.Client()
+		err := c.Serve(ctx, mux)
+		if err == ErrConcurrentRecv || ctx.Err() != nil {
+			return err
+		}
+		if err = r.reconnect(ctx, c, err); err != nil {
+			return err
+		}
+	}
+}
+
+// reconnect replaces old, whose stream failed with cause, by a new client.
+func (r *ReconnectingClient) reconnect(ctx context.Context, old *Client, cause error) error {
+	r.mu.Lock()
+	closed := r.closed
+	r.mu.Unlock()
+	if closed {
+		return ErrClientClosed
+	}
+	old.Close()
+	if r.OnDisconnect != nil {
+		r.OnDisconnect(cause)
+	}
+
+	// Close cancels the attempts, whether waiting or logging in.
+	login, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-r.done:
+			cancel()
+		case <-login.Done():
+		}
+	}()
+
+	for attempt := 0; ; attempt++ {
+		t := time.NewTimer(r.backoff(attempt))
+		select {
+		case <-r.done:
+			t.Stop()
+			return ErrClientClosed
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+
+		c, err := r.Options.newClient(login, old.smSnapshot())
+		if err != nil {
+			select {
+			case <-r.done:
+				return ErrClientClosed
+			default:
+			}
+			if _, ok := err.(*AuthError); ok || ctx.Err() != nil {
+				return err
+			}
+			continue
+		}
+
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			c.Close()
+			return ErrClientClosed
+		}
+		r.c = c
+		r.mu.Unlock()
+
+		old.restore(c)
+		if r.OnReconnect != nil {
+			r.OnReconnect(c)
+		}
+		return nil
+	}
+}
+
+// backoff returns how long to wait before the given attempt: the first one
+// waits between half and all of MinBackoff, and each one after that twice as
+// long as the one before, up to MaxBackoff.
+func (r *ReconnectingClient) backoff(attempt int) time.Duration {
+	min, max := r.MinBackoff, r.MaxBackoff
+	if min <= 0 {
+		min = time.Second
+	}
+	if max <= 0 {
+		max = 5 * time.Minute
+	}
+	d := min
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// restore hands over to the new client to the rooms joined on c and the
+// presence last set on c with SendPresence.  Unless the stream was resumed,
+// which keeps them as they were, the presence is sent again, the rooms are
+// joined again, and then the stanzas the old stream lost are sent again,
+// but for the presences this has just sent anew.
+func (c *Client) restore(to *Client) {
+	c.stateMu.Lock()
+	mucs := make(map[string]bool, len(c.mucs))
+	for jid := range c.mucs {
+		mucs[jid] = true
+	}
+	presence := c.presence
+	c.stateMu.Unlock()
+
+	if to.resumed {
+		to.stateMu.Lock()
+		to.mucs, to.presence = mucs, presence
+		to.stateMu.Unlock()
+		return
+	}
+	if presence != nil {
+		to.SendPresence(*presence)
+	}
+	for jid := range mucs {
+		to.JoinMUC(jid)
+	}
+
+	to.sendMu.Lock()
+	defer to.sendMu.Unlock()
+	for _, s := range to.unacked {
+		if !restored(s, mucs) {
+			to.write(s, true)
+		}
+	}
+	to.unacked = nil
+}
+
+// restored reports whether the stanza s is a presence that restore sends
+// anyway: an available presence broadcast, which the login and restore send
+// up to date, or one to a room in mucs, which restore joins again.
+func restored(s string, mucs map[string]bool) bool {
+	d := xml.NewDecoder(strings.NewReader(s))
+	var se xml.StartElement
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return false
+		}
+		if v, ok := t.(xml.StartElement); ok {
+			se = v
+			break
+		}
+	}
+	if se.Name.Local != "presence" {
+		return false
+	}
+	var to, typ string
+	for _, a := range se.Attr {
+		switch a.Name.Local {
+		case "to":
+			to = a.Value
+		case "type":
+			typ = a.Value
+		}
+	}
+	return typ == "" && (to == "" || mucs[to])
+}
@@ -0,0 +1,529 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/secure/precis"
+)
+
+// SASLInfo carries what a SASL Mechanism needs to know about the login.
+type SASLInfo struct {
+	User     string // localpart of the JID
+	Domain   string
+	Password string
+	AuthzID  string // authorization identity to act as, or "" for the authenticated one
+
+	TLS               *tls.ConnectionState // nil if the connection is not encrypted
+	ClientCertificate bool                 // a TLS client certificate was configured
+	Mechanisms        []string             // mechanisms offered by the server
+	ChannelBindings   []string             // channel binding types advertised by the server (XEP-0440)
+}
+
+// Mechanism is a client side SASL mechanism, such as PLAIN or SCRAM-SHA-256.
+// Implementations may keep state between Start and Next; Start must reset it,
+// and a Mechanism must not be used by two clients at once.
+type Mechanism interface {
+	// Name returns the SASL name of the mechanism, as offered by the server.
+	Name() string
+
+	// Start begins an exchange and returns the initial response, or nil if
+	// there is none.  Returning ErrMechanismUnavailable makes the client
+	// try the next mechanism instead.
+	Start(info *SASLInfo) ([]byte, error)
+
+	// Next is called with every challenge from the server (more is true) and
+	// finally with the additional data of <success> (more is false), which
+	// may be empty.
+	Next(challenge []byte, more bool) ([]byte, error)
+}
+
+// ErrMechanismUnavailable is returned by Mechanism.Start when a mechanism
+// cannot be used on this connection, such as a -PLUS mechanism without TLS.
+var ErrMechanismUnavailable = errors.New("xmpp: SASL mechanism unavailable")
+
+// DefaultMechanisms returns the mechanisms implemented by this package,
+// strongest first.  It is used when Options.Mechanisms is nil.
+func DefaultMechanisms() []Mechanism {
+	return []Mechanism{
+		&externalAuth{},
+		&scramAuth{mech: "SCRAM-SHA-512-PLUS", h: sha512.New, plus: true},
+		&scramAuth{mech: "SCRAM-SHA-256-PLUS", h: sha256.New, plus: true},
+		&scramAuth{mech: "SCRAM-SHA-1-PLUS", h: sha1.New, plus: true},
+		&scramAuth{mech: "SCRAM-SHA-512", h: sha512.New},
+		&scramAuth{mech: "SCRAM-SHA-256", h: sha256.New},
+		&scramAuth{mech: "SCRAM-SHA-1", h: sha1.New},
+		&digestMD5Auth{},
+		&plainAuth{},
+		&anonymousAuth{},
+	}
+}
+
+// authenticate runs the SASL exchange of RFC 6120 6.4 with the first of prefs
+// that the server offers and that can be used on this connection.
+func (c *Client) authenticate(prefs []Mechanism, info *SASLInfo) error {
+	m, ir, err := chooseMechanism(prefs, info)
+	if err != nil {
+		return err
+	}
+	if ir == nil {
+		fmt.Fprintf(c.conn, "<auth xmlns='%s' mechanism='%s'/>\n", nsSASL, xmlEscape(m.Name()))
+	} else {
+		fmt.Fprintf(c.conn, "<auth xmlns='%s' mechanism='%s'>%s</auth>\n",
+			nsSASL, xmlEscape(m.Name()), saslEncode(ir))
+	}
+	_, err = c.saslLoop(m)
+	return err
+}
+
+// chooseMechanism starts the first of prefs that the server offers and that
+// can be used on this connection, and returns it with its initial response.
+func chooseMechanism(prefs []Mechanism, info *SASLInfo) (Mechanism, []byte, error) {
+	if prefs == nil {
+		prefs = DefaultMechanisms()
+	}
+	for _, m := range prefs {
+		if !contains(info.Mechanisms, m.Name()) {
+			continue
+		}
+		ir, err := m.Start(info)
+		if err == ErrMechanismUnavailable {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return m, ir, nil
+	}
+	return nil, nil, fmt.Errorf("xmpp: no supported SASL mechanism offered: %v", info.Mechanisms)
+}
+
+// saslLoop answers the server's challenges until it decides.  It speaks both
+// RFC 6120 SASL and XEP-0388 SASL2, replying in the namespace of each
+// challenge; for SASL2 the <success/> element is returned.
+func (c *Client) saslLoop(m Mechanism) (*sasl2Success, error) {
+	for {
+		name, val, err := next(c.p)
+		if err != nil {
+			return nil, err
+		}
+		var challenge string
+		switch v := val.(type) {
+		case *saslChallenge:
+			challenge = string(*v)
+		case *sasl2Challenge:
+			challenge = string(*v)
+		case *saslSuccess:
+			return nil, saslVerify(m, v.Data)
+		case *sasl2Success:
+			return v, saslVerify(m, v.AdditionalData)
+		case *AuthError:
+			return nil, v
+		case *StreamError:
+			return nil, v
+		case *sasl2Continue:
+			fmt.Fprintf(c.conn, "<abort xmlns='%s'/>\n", nsSASL2)
+			return nil, errors.New("xmpp: SASL2 tasks are not supported")
+		default:
+			return nil, errors.New("expected <challenge>, <success> or <failure>, got <" + name.Local + "> in " + name.Space)
+		}
+
+		b, err := base64.StdEncoding.DecodeString(challenge)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := m.Next(b, true)
+		if err != nil {
+			fmt.Fprintf(c.conn, "<abort xmlns='%s'/>\n", name.Space)
+			return nil, err
+		}
+		if len(resp) == 0 {
+			fmt.Fprintf(c.conn, "<response xmlns='%s'/>\n", name.Space)
+		} else {
+			fmt.Fprintf(c.conn, "<response xmlns='%s'>%s</response>\n",
+				name.Space, base64.StdEncoding.EncodeToString(resp))
+		}
+	}
+}
+
+// saslVerify hands the additional data of <success/> to m.
+func saslVerify(m Mechanism, data string) error {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+	if err != nil {
+		return err
+	}
+	_, err = m.Next(b, false)
+	return err
+}
+
+// saslEncode encodes an initial response; RFC 6120 6.4.2 sends an empty one as "=".
+func saslEncode(b []byte) string {
+	if len(b) == 0 {
+		return "="
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// ANONYMOUS, RFC 4505.
+type anonymousAuth struct{}
+
+func (*anonymousAuth) Name() string                             { return "ANONYMOUS" }
+func (*anonymousAuth) Start(*SASLInfo) ([]byte, error)          { return nil, nil }
+func (*anonymousAuth) Next(_ []byte, more bool) ([]byte, error) { return nil, nil }
+
+// EXTERNAL, RFC 4422 appendix A, authenticating with the TLS client
+// certificate as described in XEP-0178.
+type externalAuth struct {
+	info *SASLInfo
+}
+
+func (*externalAuth) Name() string { return "EXTERNAL" }
+
+func (a *externalAuth) Start(info *SASLInfo) ([]byte, error) {
+	if info.TLS == nil || !info.ClientCertificate {
+		return nil, ErrMechanismUnavailable
+	}
+	a.info = info
+	return []byte(info.AuthzID), nil
+}
+
+func (a *externalAuth) Next(_ []byte, more bool) ([]byte, error) {
+	if more {
+		// the server did not accept our initial response; repeat it.
+		return []byte(a.info.AuthzID), nil
+	}
+	return nil, nil
+}
+
+// PLAIN, RFC 4616.
+type plainAuth struct{}
+
+func (*plainAuth) Name() string { return "PLAIN" }
+
+func (*plainAuth) Start(info *SASLInfo) ([]byte, error) {
+	// send authzid \x00 user \x00 password.
+	return []byte(info.AuthzID + "\x00" + info.User + "\x00" + info.Password), nil
+}
+
+func (*plainAuth) Next(_ []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, errors.New("xmpp: unexpected PLAIN challenge")
+	}
+	return nil, nil
+}
+
+// DIGEST-MD5, RFC 2831.  Deprecated by RFC 6331 but still widely deployed.
+type digestMD5Auth struct {
+	info *SASLInfo
+	step int
+}
+
+func (*digestMD5Auth) Name() string { return "DIGEST-MD5" }
+
+func (a *digestMD5Auth) Start(info *SASLInfo) ([]byte, error) {
+	a.info = info
+	a.step = 0
+	return nil, nil
+}
+
+func (a *digestMD5Auth) Next(challenge []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	a.step++
+	if a.step > 1 {
+		// rspauth; there is nothing left to say.
+		return []byte{}, nil
+	}
+	tokens := map[string]string{}
+	for _, token := range strings.Split(string(challenge), ",") {
+		kv := strings.SplitN(strings.TrimSpace(token), "=", 2)
+		if len(kv) == 2 {
+			if len(kv[1]) > 1 && kv[1][0] == '"' && kv[1][len(kv[1])-1] == '"' {
+				kv[1] = kv[1][1 : len(kv[1])-1]
+			}
+			tokens[kv[0]] = kv[1]
+		}
+	}
+	user := a.info.User
+	realm, _ := tokens["realm"]
+	nonce, _ := tokens["nonce"]
+	qop, _ := tokens["qop"]
+	charset, _ := tokens["charset"]
+	cnonceStr := cnonce()
+	digestUri := "xmpp/" + a.info.Domain
+	nonceCount := fmt.Sprintf("%08x", 1)
+	digest := saslDigestResponse(user, realm, a.info.Password, nonce, cnonceStr, "AUTHENTICATE", digestUri, nonceCount)
+	message := "username=\"" + user + "\", realm=\"" + realm + "\", nonce=\"" + nonce + "\", cnonce=\"" + cnonceStr + "\", nc=" + nonceCount + ", qop=" + qop + ", digest-uri=\"" + digestUri + "\", response=" + digest + ", charset=" + charset
+	return []byte(message), nil
+}
+
+func saslDigestResponse(username, realm, passwd, nonce, cnonceStr,
+	authenticate, digestUri, nonceCountStr string) string {
+	h := func(text string) []byte {
+		h := md5.New()
+		h.Write([]byte(text))
+		return h.Sum(nil)
+	}
+	hex := func(bytes []byte) string {
+		return fmt.Sprintf("%x", bytes)
+	}
+	kd := func(secret, data string) []byte {
+		return h(secret + ":" + data)
+	}
+
+	a1 := string(h(username+":"+realm+":"+passwd)) + ":" +
+		nonce + ":" + cnonceStr
+	a2 := authenticate + ":" + digestUri
+	response := hex(kd(hex(h(a1)), nonce+":"+
+		nonceCountStr+":"+cnonceStr+":auth:"+
+		hex(h(a2))))
+	return response
+}
+
+func cnonce() string {
+	randSize := big.NewInt(0)
+	randSize.Lsh(big.NewInt(1), 64)
+	cn, err := rand.Int(rand.Reader, randSize)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%016x", cn)
+}
+
+// SCRAM-SHA-1, SCRAM-SHA-256 and SCRAM-SHA-512, RFC 5802 and RFC 7677, and
+// their -PLUS variants which bind the exchange to the TLS channel.
+type scramAuth struct {
+	mech string
+	h    func() hash.Hash
+	plus bool
+
+	password        string // prepared with OpaqueString
+	gs2Header       string
+	cbData          []byte
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func (a *scramAuth) Name() string { return a.mech }
+
+// scramNonce returns a fresh client nonce.  Tests replace it to follow the
+// examples of the RFCs.
+var scramNonce = func() (string, error) {
+	var buf [24]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf[:]), nil
+}
+
+func (a *scramAuth) Start(info *SASLInfo) ([]byte, error) {
+	nonce, err := scramNonce()
+	if err != nil {
+		return nil, err
+	}
+	authz := ",,"
+	if info.AuthzID != "" {
+		authz = ",a=" + scramEscape(info.AuthzID) + ","
+	}
+	cbType, cbData := channelBinding(info)
+	switch {
+	case a.plus && cbType == "":
+		return nil, ErrMechanismUnavailable
+	case a.plus:
+		a.gs2Header = "p=" + cbType + authz
+		a.cbData = cbData
+	case cbType != "" && !offersPlus(info.Mechanisms):
+		// we could bind to the channel, but the server can not.
+		a.gs2Header = "y" + authz
+		a.cbData = nil
+	default:
+		a.gs2Header = "n" + authz
+		a.cbData = nil
+	}
+	// RFC 5802 prepares the username and password with SASLprep, which
+	// RFC 8265 replaces with the OpaqueString profile.
+	user, err := precis.OpaqueString.String(info.User)
+	if err != nil {
+		return nil, errors.New("xmpp: invalid " + a.mech + " username: " + err.Error())
+	}
+	password, err := precis.OpaqueString.String(info.Password)
+	if err != nil {
+		return nil, errors.New("xmpp: invalid " + a.mech + " password: " + err.Error())
+	}
+	a.password = password
+	a.serverSignature = nil
+	a.clientNonce = nonce
+	a.clientFirstBare = "n=" + scramEscape(user) + ",r=" + a.clientNonce
+	return []byte(a.gs2Header + a.clientFirstBare), nil
+}
+
+func (a *scramAuth) Next(challenge []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, a.verify(challenge)
+	}
+	if a.serverSignature != nil {
+		return nil, errors.New("xmpp: unexpected " + a.mech + " challenge")
+	}
+
+	serverFirst := string(challenge)
+	attrs := scramAttrs(serverFirst)
+	if _, ok := attrs["m"]; ok {
+		return nil, errors.New("xmpp: unsupported " + a.mech + " extension")
+	}
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, a.clientNonce) || len(nonce) == len(a.clientNonce) {
+		return nil, errors.New("xmpp: " + a.mech + " server nonce does not extend client nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("xmpp: invalid " + a.mech + " salt")
+	}
+	iter, err := strconv.Atoi(attrs["i"])
+	if err != nil || iter <= 0 {
+		return nil, errors.New("xmpp: invalid " + a.mech + " iteration count")
+	}
+
+	salted, err := pbkdf2.Key(a.h, a.password, salt, iter, a.h().Size())
+	if err != nil {
+		return nil, err
+	}
+	clientKey := a.hmac(salted, "Client Key")
+	storedKey := a.hash(clientKey)
+	serverKey := a.hmac(salted, "Server Key")
+
+	cbind := append([]byte(a.gs2Header), a.cbData...)
+	clientFinal := "c=" + base64.StdEncoding.EncodeToString(cbind) + ",r=" + nonce
+	authMessage := a.clientFirstBare + "," + serverFirst + "," + clientFinal
+	clientSignature := a.hmac(storedKey, authMessage)
+	proof := make([]byte, len(clientKey))
+	subtle.XORBytes(proof, clientKey, clientSignature)
+	a.serverSignature = a.hmac(serverKey, authMessage)
+
+	return []byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verify checks the server-final-message, which proves that the server knows
+// the password too.
+func (a *scramAuth) verify(serverFinal []byte) error {
+	if a.serverSignature == nil {
+		return errors.New("xmpp: " + a.mech + " exchange incomplete")
+	}
+	attrs := scramAttrs(string(serverFinal))
+	if e, ok := attrs["e"]; ok {
+		return errors.New("xmpp: " + a.mech + " server error: " + e)
+	}
+	v, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || !hmac.Equal(v, a.serverSignature) {
+		return errors.New("xmpp: " + a.mech + " server signature mismatch")
+	}
+	return nil
+}
+
+func (a *scramAuth) hmac(key []byte, s string) []byte {
+	m := hmac.New(a.h, key)
+	m.Write([]byte(s))
+	return m.Sum(nil)
+}
+
+func (a *scramAuth) hash(b []byte) []byte {
+	h := a.h()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// channelBinding picks a TLS channel binding type that the server supports and
+// returns it with its data, or "" if none can be used.  tls-exporter (RFC 9266)
+// is preferred; tls-unique (RFC 5929) is only available with TLS 1.2.
+func channelBinding(info *SASLInfo) (string, []byte) {
+	if info.TLS == nil {
+		return "", nil
+	}
+	for _, t := range []string{"tls-exporter", "tls-unique"} {
+		if len(info.ChannelBindings) > 0 && !contains(info.ChannelBindings, t) {
+			continue
+		}
+		switch t {
+		case "tls-exporter":
+			if info.TLS.Version < tls.VersionTLS13 {
+				// Without TLS 1.3 the exporter is only safe with the
+				// extended master secret, which Go does not report.
+				continue
+			}
+			b, err := info.TLS.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+			if err == nil {
+				return t, b
+			}
+		case "tls-unique":
+			if len(info.TLS.TLSUnique) > 0 {
+				return t, info.TLS.TLSUnique
+			}
+		}
+	}
+	return "", nil
+}
+
+func offersPlus(mechanisms []string) bool {
+	for _, m := range mechanisms {
+		if strings.HasSuffix(m, "-PLUS") {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// scramAttrs splits a SCRAM message into its attribute-value pairs.
+func scramAttrs(s string) map[string]string {
+	attrs := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		if len(kv) >= 2 && kv[1] == '=' {
+			attrs[kv[:1]] = kv[2:]
+		}
+	}
+	return attrs
+}
+
+// scramEscape encodes the characters that may not appear in a SCRAM saslname.
+func scramEscape(s string) string {
+	var b bytes.Buffer
+	for _, r := range s {
+		switch r {
+		case '=':
+			b.WriteString("=3D")
+		case ',':
+			b.WriteString("=2C")
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
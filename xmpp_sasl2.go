@@ -0,0 +1,190 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+)
+
+const (
+	nsSASL2   = "urn:xmpp:sasl:2"
+	nsBind2   = "urn:xmpp:bind:0"
+	nsCarbons = "urn:xmpp:carbons:2"
+)
+
+// authenticate2 logs in with Extensible SASL Profile (XEP-0388).  If the server
+// supports Bind 2 (XEP-0386) and o.Resource is empty, the resource is bound in
+// the same round trip and bound is true; otherwise the caller still has to
+// bind.  SASL2 does not
+// restart the stream.
+func (c *Client) authenticate2(o *Options, auth *sasl2Authentication, info *SASLInfo) (bound bool, err error) {
+	fast := o.TokenStore != nil && o.UserAgentID != "" && auth.Inline.Fast != nil
+	if fast {
+		// Try the stored FAST token first; if the server refuses it, forget
+		// it and fall back to the password on the same stream.
+		success, err := c.fastAuthenticate(o, auth, info)
+		if success != nil {
+			return c.sasl2Bound(success)
+		}
+		if _, ok := err.(*AuthError); ok {
+			if serr := o.TokenStore.StoreToken(o.User, nil); serr != nil {
+				return false, serr
+			}
+			if o.Password == "" {
+				return false, err
+			}
+		} else if err != nil {
+			return false, err
+		}
+	}
+
+	m, ir, err := chooseMechanism(o.Mechanisms, info)
+	if err != nil {
+		return false, err
+	}
+	extra, mech := "", ""
+	if fast {
+		if mech = fastMechanism(auth.Inline.Fast.Mechanism, info); mech != "" {
+			extra = fmt.Sprintf("<request-token xmlns='%s' mechanism='%s'/>", nsFAST, mech)
+		}
+	}
+	success, err := c.sasl2Exchange(o, auth, m, ir, extra)
+	if err != nil {
+		return false, err
+	}
+	if mech != "" {
+		if err = c.storeToken(o, mech, success.Token); err != nil {
+			return false, err
+		}
+	}
+	return c.sasl2Bound(success)
+}
+
+// sasl2Exchange sends <authenticate/> for m with the initial response ir,
+// user agent, Bind 2 request and the inline elements in extra, and runs the
+// exchange to the end.
+func (c *Client) sasl2Exchange(o *Options, auth *sasl2Authentication, m Mechanism, ir []byte, extra string) (*sasl2Success, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<authenticate xmlns='%s' mechanism='%s'>", nsSASL2, xmlEscape(m.Name()))
+	if ir != nil {
+		fmt.Fprintf(&b, "<initial-response>%s</initial-response>", saslEncode(ir))
+	}
+	if o.UserAgentID != "" {
+		fmt.Fprintf(&b, "<user-agent id='%s'><software>go-xmpp</software></user-agent>", xmlEscape(o.UserAgentID))
+	}
+	c.carbons = false
+	if auth.Inline.Bind != nil && o.Resource == "" {
+		// Bind 2 only lets us tag the resource the server picks, so a
+		// resource of our choosing is bound the RFC 6120 way afterwards.
+		fmt.Fprintf(&b, "<bind xmlns='%s'>", nsBind2)
+		if o.Carbons && auth.Inline.Bind.supports(nsCarbons) {
+			fmt.Fprintf(&b, "<enable xmlns='%s'/>", nsCarbons)
+			c.carbons = true
+		}
+		if o.StreamManagement && auth.Inline.Bind.supports(nsSM) {
+			fmt.Fprintf(&b, "<enable xmlns='%s' resume='true'/>", nsSM)
+		}
+		b.WriteString("</bind>")
+	}
+	if c.prev != nil && c.prev.canResume() && auth.Inline.SM != nil {
+		// If the server cannot resume, it binds instead, if asked to.
+		fmt.Fprintf(&b, "<resume xmlns='%s' h='%d' previd='%s'/>", nsSM, c.prev.in, xmlEscape(c.prev.id))
+	}
+	b.WriteString(extra)
+	b.WriteString("</authenticate>\n")
+	if _, err := c.conn.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+
+	success, err := c.saslLoop(m)
+	if err == nil && success == nil {
+		err = errors.New("xmpp: expected SASL2 <success>")
+	}
+	if err != nil {
+		c.carbons = false
+		return nil, err
+	}
+	return success, nil
+}
+
+// sasl2Bound records the outcome of the Bind 2 request, if any, in c.
+func (c *Client) sasl2Bound(success *sasl2Success) (bool, error) {
+	if success.Resumed != nil {
+		c.carbons = false
+		return true, c.smResumed(success.Resumed.H)
+	}
+	if success.Failed != nil && c.prev != nil {
+		success.Failed.ackPrev(c.prev)
+	}
+	if success.Bound == nil {
+		c.carbons = false
+		return false, nil
+	}
+	if success.AuthorizationIdentifier == "" {
+		return false, errors.New("xmpp: SASL2 <success> missing <authorization-identifier>")
+	}
+	c.jid = success.AuthorizationIdentifier
+	if success.Bound.Enabled != nil {
+		c.smEnabled(success.Bound.Enabled)
+	}
+	return true, nil
+}
+
+// XEP-0388  Extensible SASL Profile
+
+type sasl2Authentication struct {
+	XMLName   xml.Name `xml:"urn:xmpp:sasl:2 authentication"`
+	Mechanism []string `xml:"mechanism"`
+	Inline    struct {
+		Bind *bind2Bind
+		Fast *fastFeature
+		SM   *smFeature
+	} `xml:"inline"`
+}
+
+type sasl2Challenge string
+
+type sasl2Success struct {
+	XMLName                 xml.Name `xml:"urn:xmpp:sasl:2 success"`
+	AdditionalData          string   `xml:"additional-data"`
+	AuthorizationIdentifier string   `xml:"authorization-identifier"`
+	Bound                   *bind2Bound
+	Token                   *fastToken
+	Resumed                 *smResumed
+	Failed                  *smFailed
+}
+
+type sasl2Continue struct {
+	XMLName xml.Name `xml:"urn:xmpp:sasl:2 continue"`
+}
+
+// XEP-0386  Bind 2
+
+type bind2Bind struct {
+	XMLName xml.Name `xml:"urn:xmpp:bind:0 bind"`
+	Inline  struct {
+		Feature []struct {
+			Var string `xml:"var,attr"`
+		} `xml:"feature"`
+	} `xml:"inline"`
+}
+
+// supports reports whether the server accepts ns inline in a Bind 2 request.
+func (b *bind2Bind) supports(ns string) bool {
+	for _, f := range b.Inline.Feature {
+		if f.Var == ns {
+			return true
+		}
+	}
+	return false
+}
+
+type bind2Bound struct {
+	XMLName xml.Name `xml:"urn:xmpp:bind:0 bound"`
+	Enabled *smEnabled
+}
@@ -0,0 +1,188 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"hash"
+	"strings"
+	"testing"
+)
+
+// withNonce makes SCRAM use nonce as the client nonce until the test ends.
+func withNonce(t *testing.T, nonce string) {
+	saved := scramNonce
+	scramNonce = func() (string, error) { return nonce, nil }
+	t.Cleanup(func() { scramNonce = saved })
+}
+
+// The examples of RFC 5802 section 5 and RFC 7677 section 3.
+var scramTests = []struct {
+	mech        string
+	h           func() hash.Hash
+	nonce       string
+	clientFirst string
+	serverFirst string
+	clientFinal string
+	serverFinal string
+}{
+	{
+		mech:        "SCRAM-SHA-1",
+		h:           sha1.New,
+		nonce:       "fyko+d2lbbFgONRv9qkxdawL",
+		clientFirst: "n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL",
+		serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+		clientFinal: "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+		serverFinal: "v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+	},
+	{
+		mech:        "SCRAM-SHA-256",
+		h:           sha256.New,
+		nonce:       "rOprNGfwEbeRWgbNEkqO",
+		clientFirst: "n,,n=user,r=rOprNGfwEbeRWgbNEkqO",
+		serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+	},
+}
+
+func TestSCRAM(t *testing.T) {
+	for _, tt := range scramTests {
+		withNonce(t, tt.nonce)
+		a := &scramAuth{mech: tt.mech, h: tt.h}
+		info := &SASLInfo{User: "user", Password: "pencil", Mechanisms: []string{tt.mech}}
+
+		out, err := a.Start(info)
+		if err != nil || string(out) != tt.clientFirst {
+			t.Errorf("%s: Start = %q, %v; want %q", tt.mech, out, err, tt.clientFirst)
+			continue
+		}
+		out, err = a.Next([]byte(tt.serverFirst), true)
+		if err != nil || string(out) != tt.clientFinal {
+			t.Errorf("%s: Next = %q, %v; want %q", tt.mech, out, err, tt.clientFinal)
+			continue
+		}
+		if _, err = a.Next([]byte(tt.serverFinal), false); err != nil {
+			t.Errorf("%s: server signature rejected: %v", tt.mech, err)
+		}
+
+		// A server that does not know the password is caught.
+		a.Start(info)
+		a.Next([]byte(tt.serverFirst), true)
+		bad := "v=" + base64.StdEncoding.EncodeToString(make([]byte, tt.h().Size()))
+		if _, err = a.Next([]byte(bad), false); err == nil {
+			t.Errorf("%s: wrong server signature accepted", tt.mech)
+		}
+	}
+}
+
+func TestSCRAMRejectsServerFirst(t *testing.T) {
+	withNonce(t, "abc")
+	for _, serverFirst := range []string{
+		"r=abc,s=QSXCR+Q6sek8bf92,i=4096",       // nonce not extended
+		"r=xyzdef,s=QSXCR+Q6sek8bf92,i=4096",    // nonce not ours
+		"r=abcdef,s=!!,i=4096",                  // bad salt
+		"r=abcdef,s=QSXCR+Q6sek8bf92,i=0",       // bad iteration count
+		"m=ext,r=abcdef,s=QSXCR+Q6sek8bf92,i=1", // mandatory extension
+	} {
+		a := &scramAuth{mech: "SCRAM-SHA-1", h: sha1.New}
+		if _, err := a.Start(&SASLInfo{User: "user", Password: "pencil"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.Next([]byte(serverFirst), true); err == nil {
+			t.Errorf("server-first-message %q accepted", serverFirst)
+		}
+	}
+}
+
+func TestSCRAMHeader(t *testing.T) {
+	withNonce(t, "abc")
+	tls12 := &tls.ConnectionState{Version: tls.VersionTLS12, TLSUnique: []byte("unique")}
+	tests := []struct {
+		plus        bool
+		info        SASLInfo
+		clientFirst string
+		cbind       string // decoded c= attribute of the client-final-message
+	}{
+		{
+			info:        SASLInfo{User: "user"},
+			clientFirst: "n,,n=user,r=abc",
+			cbind:       "n,,",
+		},
+		{
+			info:        SASLInfo{User: "u,=ser", AuthzID: "admin@example.com"},
+			clientFirst: "n,a=admin@example.com,n=u=2C=3Dser,r=abc",
+			cbind:       "n,a=admin@example.com,",
+		},
+		{
+			info:        SASLInfo{User: "user", AuthzID: "a=b,c"},
+			clientFirst: "n,a=a=3Db=2Cc,n=user,r=abc",
+			cbind:       "n,a=a=3Db=2Cc,",
+		},
+		{
+			// we could bind to the channel, but the server does not offer -PLUS.
+			info:        SASLInfo{User: "user", TLS: tls12, Mechanisms: []string{"SCRAM-SHA-1"}},
+			clientFirst: "y,,n=user,r=abc",
+			cbind:       "y,,",
+		},
+		{
+			info:        SASLInfo{User: "user", TLS: tls12, Mechanisms: []string{"SCRAM-SHA-1", "SCRAM-SHA-1-PLUS"}},
+			clientFirst: "n,,n=user,r=abc",
+			cbind:       "n,,",
+		},
+		{
+			plus:        true,
+			info:        SASLInfo{User: "user", TLS: tls12},
+			clientFirst: "p=tls-unique,,n=user,r=abc",
+			cbind:       "p=tls-unique,,unique",
+		},
+		{
+			plus:        true,
+			info:        SASLInfo{User: "user", AuthzID: "admin", TLS: tls12},
+			clientFirst: "p=tls-unique,a=admin,n=user,r=abc",
+			cbind:       "p=tls-unique,a=admin,unique",
+		},
+	}
+	for _, tt := range tests {
+		tt.info.Password = "pencil"
+		a := &scramAuth{mech: "SCRAM-SHA-1", h: sha1.New, plus: tt.plus}
+		out, err := a.Start(&tt.info)
+		if err != nil || string(out) != tt.clientFirst {
+			t.Errorf("Start(%+v) = %q, %v; want %q", tt.info, out, err, tt.clientFirst)
+			continue
+		}
+		out, err = a.Next([]byte("r=abcdef,s=QSXCR+Q6sek8bf92,i=1"), true)
+		if err != nil {
+			t.Errorf("Next: %v", err)
+			continue
+		}
+		c := scramAttrs(string(out))["c"]
+		if cbind, _ := base64.StdEncoding.DecodeString(c); string(cbind) != tt.cbind {
+			t.Errorf("%q: channel binding %q, want %q", tt.clientFirst, cbind, tt.cbind)
+		}
+	}
+
+	// -PLUS needs a channel to bind to.
+	a := &scramAuth{mech: "SCRAM-SHA-1-PLUS", h: sha1.New, plus: true}
+	if _, err := a.Start(&SASLInfo{User: "user", Password: "pencil"}); err != ErrMechanismUnavailable {
+		t.Errorf("SCRAM-SHA-1-PLUS without TLS: got %v, want %v", err, ErrMechanismUnavailable)
+	}
+}
+
+func TestSCRAMPrepare(t *testing.T) {
+	withNonce(t, "abc")
+	a := &scramAuth{mech: "SCRAM-SHA-1", h: sha1.New}
+	// OpaqueString maps non-ASCII spaces to ASCII ones and normalizes to NFC.
+	out, err := a.Start(&SASLInfo{User: "u\u00a0se\u0301r", Password: "pencil"})
+	if err != nil || !strings.HasPrefix(string(out), "n,,n=u s\u00e9r,") {
+		t.Errorf("Start = %q, %v; want the username prepared", out, err)
+	}
+	if _, err := a.Start(&SASLInfo{User: "user", Password: "pen\u0007cil"}); err == nil {
+		t.Error("password with a control character accepted")
+	}
+}
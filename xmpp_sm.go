@@ -0,0 +1,221 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const nsSM = "urn:xmpp:sm:3"
+
+// smState is the Stream Management (XEP-0198) state of a stream.  It
+// outlives the stream: a new stream resumes it, or at least sends again the
+// stanzas the server had not acknowledged.
+type smState struct {
+	id        string // stream id to resume, if resumption was granted
+	location  string // preferred host to resume at, if any
+	directTLS bool   // whether location expects direct TLS
+	jid       string // bound JID
+
+	in    uint32   // stanzas received and handled
+	out   uint32   // stanzas the server has acknowledged
+	queue []string // stanzas sent but not acknowledged yet, oldest first
+}
+
+// canResume reports whether the server allowed the stream to be resumed.
+func (s *smState) canResume() bool {
+	return s.id != ""
+}
+
+// ack drops the stanzas acknowledged by h, the server's count of handled
+// stanzas.
+func (s *smState) ack(h uint32) {
+	n := h - s.out
+	if int(n) > len(s.queue) {
+		n = uint32(len(s.queue))
+	}
+	s.queue = s.queue[n:]
+	s.out = h
+}
+
+// write writes s to the stream.  If s is a stanza and stream management is
+// enabled, s is kept until the server acknowledges it, and an acknowledgement
+// is requested.  The caller holds c.sendMu, or is logging in.
+func (c *Client) write(s string, stanza bool) (int, error) {
+	n, err := io.WriteString(c.conn, s)
+	if stanza && c.sm != nil {
+		c.sm.queue = append(c.sm.queue, s)
+		if err == nil {
+			_, err = fmt.Fprintf(c.conn, "<r xmlns='%s'/>", nsSM)
+		}
+	}
+	return n, err
+}
+
+// isStanza reports whether s, raw XML written by the user, starts with a
+// stanza rather than some other element or whitespace.
+func isStanza(s string) bool {
+	s = strings.TrimSpace(s)
+	for _, name := range []string{"<message", "<presence", "<iq"} {
+		if strings.HasPrefix(s, name) && len(s) > len(name) && strings.IndexByte(" \t\r\n/>", s[len(name)]) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// smInbound does the stream management bookkeeping for val, an element read
+// from the stream, and reports whether val was for stream management only.
+// The caller holds c.sendMu, or is logging in.
+func (c *Client) smInbound(val interface{}) bool {
+	if c.sm == nil {
+		return false
+	}
+	switch v := val.(type) {
+	case *clientMessage, *clientPresence, *clientIQ:
+		c.sm.in++
+	case *smRequest:
+		fmt.Fprintf(c.conn, "<a xmlns='%s' h='%d'/>", nsSM, c.sm.in)
+		return true
+	case *smAck:
+		c.sm.ack(v.H)
+		return true
+	}
+	return false
+}
+
+// smEnable enables stream management with resumption, once the resource is
+// bound.  A server that refuses is not an error.
+func (c *Client) smEnable() error {
+	fmt.Fprintf(c.conn, "<enable xmlns='%s' resume='true'/>\n", nsSM)
+	for {
+		_, val, err := next(c.p)
+		if err != nil {
+			return err
+		}
+		switch v := val.(type) {
+		case *smEnabled:
+			c.smEnabled(v)
+			return nil
+		case *smFailed:
+			return nil
+		case *StreamError:
+			return v
+		}
+	}
+}
+
+// smEnabled records the server's acceptance of <enable/>.
+func (c *Client) smEnabled(v *smEnabled) {
+	c.sm = &smState{location: v.Location, directTLS: c.endpoint.directTLS, jid: c.jid}
+	if v.Resume == "true" || v.Resume == "1" {
+		c.sm.id = v.ID
+	}
+}
+
+// smResume asks to resume c.prev in place of binding a resource, and reports
+// whether the server agreed.
+func (c *Client) smResume() (bool, error) {
+	fmt.Fprintf(c.conn, "<resume xmlns='%s' h='%d' previd='%s'/>\n", nsSM, c.prev.in, xmlEscape(c.prev.id))
+	for {
+		_, val, err := next(c.p)
+		if err != nil {
+			return false, err
+		}
+		switch v := val.(type) {
+		case *smResumed:
+			return true, c.smResumed(v.H)
+		case *smFailed:
+			v.ackPrev(c.prev)
+			return false, nil
+		case *StreamError:
+			return false, v
+		}
+	}
+}
+
+// smResumed takes over c.prev once the server has resumed it, h being the
+// number of our stanzas it handled, and sends again the ones it missed.
+func (c *Client) smResumed(h uint32) error {
+	c.sm = c.prev
+	c.jid = c.sm.jid
+	c.resumed = true
+	c.sm.ack(h)
+	return c.resend()
+}
+
+// resend sends again the stanzas of c.prev that the server did not
+// acknowledge.  With stream management enabled on this stream they are kept
+// again until acknowledged.
+func (c *Client) resend() error {
+	queue := c.prev.queue
+	if c.sm == c.prev {
+		c.sm.queue = nil
+	}
+	for _, s := range queue {
+		if _, err := c.write(s, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// smSnapshot returns a copy of the stream management state, for a new stream
+// to take over, or nil.
+func (c *Client) smSnapshot() *smState {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.sm == nil {
+		return nil
+	}
+	s := *c.sm
+	s.queue = append([]string(nil), c.sm.queue...)
+	return &s
+}
+
+// XEP-0198  Stream Management
+
+type smFeature struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 sm"`
+}
+
+type smEnabled struct {
+	XMLName  xml.Name `xml:"urn:xmpp:sm:3 enabled"`
+	ID       string   `xml:"id,attr"`
+	Resume   string   `xml:"resume,attr"`
+	Location string   `xml:"location,attr"`
+}
+
+type smResumed struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 resumed"`
+	H       uint32   `xml:"h,attr"`
+	PrevID  string   `xml:"previd,attr"`
+}
+
+type smFailed struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 failed"`
+	H       string   `xml:"h,attr"`
+}
+
+// ackPrev applies the count of handled stanzas that a failed resumption may
+// carry to the state that could not be resumed.
+func (v *smFailed) ackPrev(prev *smState) {
+	if h, err := strconv.ParseUint(v.H, 10, 32); err == nil {
+		prev.ack(uint32(h))
+	}
+}
+
+type smRequest struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 r"`
+}
+
+type smAck struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 a"`
+	H       uint32   `xml:"h,attr"`
+}
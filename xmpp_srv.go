@@ -0,0 +1,129 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultPort = 5222
+
+// Resolver looks up DNS SRV records.  *net.Resolver satisfies this interface;
+// tests may substitute their own implementation to avoid using the real DNS.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+}
+
+// endpoint is a single address a client may connect to.
+type endpoint struct {
+	addr      string // host:port
+	directTLS bool   // the port expects TLS from the outset (XEP-0368)
+	priority  uint16
+	weight    uint16
+}
+
+// lookupEndpoints resolves the _xmpps-client._tcp (XEP-0368) and _xmpp-client._tcp
+// (RFC 6120 3.2.1) SRV records of domain.  The records are merged and ordered by
+// priority and weight as described in RFC 2782; at equal priority direct TLS
+// endpoints come first.  An empty result means that neither service was found.
+func lookupEndpoints(ctx context.Context, r Resolver, domain string) []endpoint {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	var eps []endpoint
+	for _, s := range []struct {
+		service   string
+		directTLS bool
+	}{
+		{"xmpps-client", true},
+		{"xmpp-client", false},
+	} {
+		_, addrs, err := r.LookupSRV(ctx, s.service, "tcp", domain)
+		if err != nil {
+			continue
+		}
+		// A single record with a target of "." means that the service is
+		// decidedly not available at this domain.
+		if len(addrs) == 1 && (addrs[0].Target == "." || addrs[0].Target == "") {
+			continue
+		}
+		for _, a := range addrs {
+			target := strings.TrimSuffix(a.Target, ".")
+			if target == "" {
+				continue
+			}
+			eps = append(eps, endpoint{
+				addr:      net.JoinHostPort(target, strconv.Itoa(int(a.Port))),
+				directTLS: s.directTLS,
+				priority:  a.Priority,
+				weight:    a.Weight,
+			})
+		}
+	}
+	return orderEndpoints(eps)
+}
+
+// orderEndpoints sorts eps by ascending priority and, within a priority,
+// picks a random weighted order as described in RFC 2782.
+func orderEndpoints(eps []endpoint) []endpoint {
+	sort.SliceStable(eps, func(i, j int) bool {
+		if eps[i].priority != eps[j].priority {
+			return eps[i].priority < eps[j].priority
+		}
+		return eps[i].directTLS && !eps[j].directTLS
+	})
+	out := make([]endpoint, 0, len(eps))
+	for i := 0; i < len(eps); {
+		j := i
+		for j < len(eps) && eps[j].priority == eps[i].priority && eps[j].directTLS == eps[i].directTLS {
+			j++
+		}
+		out = append(out, weightedOrder(eps[i:j])...)
+		i = j
+	}
+	return out
+}
+
+func weightedOrder(eps []endpoint) []endpoint {
+	eps = append([]endpoint(nil), eps...)
+	// Records with a weight of zero go first so that they have a small
+	// chance of being picked.
+	sort.SliceStable(eps, func(i, j int) bool { return eps[i].weight == 0 && eps[j].weight != 0 })
+	out := make([]endpoint, 0, len(eps))
+	for len(eps) > 0 {
+		sum := 0
+		for _, e := range eps {
+			sum += int(e.weight)
+		}
+		// When all that is left weighs zero, any of it is as likely.
+		n := rand.Intn(len(eps))
+		if sum > 0 {
+			r := rand.Intn(sum + 1)
+			for n = 0; n < len(eps)-1; n++ {
+				r -= int(eps[n].weight)
+				if r <= 0 {
+					break
+				}
+			}
+		}
+		out = append(out, eps[n])
+		eps = append(eps[:n], eps[n+1:]...)
+	}
+	return out
+}
+
+// hostEndpoint turns a "hostname" or "hostname:port" option into an endpoint,
+// defaulting the port to 5222.
+func hostEndpoint(host string, directTLS bool) endpoint {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(defaultPort))
+	}
+	return endpoint{addr: host, directTLS: directTLS}
+}
@@ -0,0 +1,151 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// fakeResolver answers SRV lookups from a map by service, and fails for the
+// services it does not know.
+type fakeResolver map[string][]*net.SRV
+
+func (r fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	addrs, ok := r[service]
+	if !ok || proto != "tcp" || name != "example.com" {
+		return "", nil, errors.New("no such host")
+	}
+	return "_" + service + "._tcp.example.com.", addrs, nil
+}
+
+// addrs returns the addresses of eps, with a "tls " prefix for direct TLS.
+func addrs(eps []endpoint) []string {
+	var s []string
+	for _, e := range eps {
+		if e.directTLS {
+			s = append(s, "tls "+e.addr)
+		} else {
+			s = append(s, e.addr)
+		}
+	}
+	return s
+}
+
+func TestEndpoints(t *testing.T) {
+	tests := []struct {
+		name string
+		r    fakeResolver
+		want []string
+	}{
+		{
+			name: "priority",
+			r: fakeResolver{"xmpp-client": {
+				{Target: "b.example.com.", Port: 5222, Priority: 20},
+				{Target: "a.example.com.", Port: 5222, Priority: 10},
+				{Target: "c.example.com.", Port: 5269, Priority: 30},
+			}},
+			want: []string{"a.example.com:5222", "b.example.com:5222", "c.example.com:5269"},
+		},
+		{
+			name: "direct TLS first at equal priority",
+			r: fakeResolver{
+				"xmpp-client": {
+					{Target: "starttls.example.com.", Port: 5222, Priority: 10},
+					{Target: "backup.example.com.", Port: 5222, Priority: 5},
+				},
+				"xmpps-client": {
+					{Target: "direct.example.com.", Port: 5223, Priority: 10},
+					{Target: "last.example.com.", Port: 5223, Priority: 20},
+				},
+			},
+			want: []string{"backup.example.com:5222", "tls direct.example.com:5223", "starttls.example.com:5222", "tls last.example.com:5223"},
+		},
+		{
+			name: "direct TLS unavailable",
+			r: fakeResolver{
+				"xmpp-client":  {{Target: "xmpp.example.com.", Port: 5222}},
+				"xmpps-client": {{Target: "."}},
+			},
+			want: []string{"xmpp.example.com:5222"},
+		},
+		{
+			name: "both services unavailable",
+			r: fakeResolver{
+				"xmpp-client":  {{Target: "."}},
+				"xmpps-client": {{Target: "."}},
+			},
+			want: []string{"example.com:5222"},
+		},
+		{
+			name: "no records",
+			r:    fakeResolver{},
+			want: []string{"example.com:5222"},
+		},
+		{
+			name: "IPv6 target",
+			r:    fakeResolver{"xmpp-client": {{Target: "::1", Port: 5222}}},
+			want: []string{"[::1]:5222"},
+		},
+	}
+	for _, tt := range tests {
+		o := Options{Resolver: tt.r}
+		if got := addrs(o.endpoints(context.Background(), "example.com")); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEndpointsWeighted(t *testing.T) {
+	r := fakeResolver{"xmpp-client": {
+		{Target: "zero.example.com.", Port: 5222, Priority: 10, Weight: 0},
+		{Target: "light.example.com.", Port: 5222, Priority: 10, Weight: 10},
+		{Target: "heavy.example.com.", Port: 5222, Priority: 10, Weight: 90},
+		{Target: "later.example.com.", Port: 5222, Priority: 20, Weight: 1000},
+	}}
+	const runs = 4000
+	first := make(map[string]int)
+	for i := 0; i < runs; i++ {
+		got := addrs(lookupEndpoints(context.Background(), r, "example.com"))
+		if len(got) != 4 || got[3] != "later.example.com:5222" {
+			t.Fatalf("got %q, want the three records of priority 10 before the other", got)
+		}
+		first[got[0]]++
+	}
+	// RFC 2782 picks a record of weight w first with probability
+	// w/(sum+1), and one of weight zero with 1/(sum+1).
+	for _, c := range []struct {
+		addr     string
+		min, max int
+	}{
+		{"heavy.example.com:5222", runs * 80 / 100, runs * 98 / 100},
+		{"light.example.com:5222", runs * 5 / 100, runs * 15 / 100},
+		{"zero.example.com:5222", 1, runs * 5 / 100},
+	} {
+		if n := first[c.addr]; n < c.min || n > c.max {
+			t.Errorf("%s first %d times out of %d, want %d to %d", c.addr, n, runs, c.min, c.max)
+		}
+	}
+
+	// Records that all weigh zero come in any order.
+	r = fakeResolver{"xmpp-client": {
+		{Target: "a.example.com.", Port: 5222},
+		{Target: "b.example.com.", Port: 5222},
+	}}
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		got := addrs(lookupEndpoints(context.Background(), r, "example.com"))
+		if len(got) != 2 {
+			t.Fatalf("got %q, want two records", got)
+		}
+		seen[got[0]] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("records of weight zero always in the same order: %v", seen)
+	}
+}
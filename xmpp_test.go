@@ -0,0 +1,622 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeServer is an XMPP server on a local port, which logs in whoever
+// connects with PLAIN and binds them to user@example.com/res.
+type fakeServer struct {
+	ln       net.Listener
+	tls      *tls.Config // of the server
+	client   *tls.Config // trusts the certificate of the server
+	starttls string      // "", "offered", "required" or "refused"
+	sm       bool        // offer stream management, without resumption
+
+	// stanza, if set, is called with each top-level element received
+	// after login.
+	stanza func(fc *fakeConn, se xml.StartElement, inner string)
+}
+
+// fakeConn is a connection accepted by a fakeServer.
+type fakeConn struct {
+	net.Conn
+	d *xml.Decoder
+}
+
+func (fc *fakeConn) send(s string) {
+	fmt.Fprint(fc.Conn, s)
+}
+
+// next reads the next top-level element and returns its inner XML, or
+// nothing for a stream header.
+func (fc *fakeConn) next() (xml.StartElement, string, error) {
+	for {
+		t, err := fc.d.Token()
+		if err != nil {
+			return xml.StartElement{}, "", err
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if se.Name.Local == "stream" {
+			return se, "", nil
+		}
+		var v struct {
+			Inner string `xml:",innerxml"`
+		}
+		err = fc.d.DecodeElement(&v, &se)
+		return se, v.Inner, err
+	}
+}
+
+// newFakeServer starts a fakeServer that accepts a single connection.
+func newFakeServer(t *testing.T, starttls string) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	fs := &fakeServer{ln: ln, starttls: starttls}
+	fs.tls, fs.client = testTLS(t)
+	go fs.serve()
+	return fs
+}
+
+// options returns Options that connect to fs without TLS.
+func (fs *fakeServer) options() Options {
+	return Options{
+		Host:                         fs.ln.Addr().String(),
+		User:                         "user@example.com",
+		Password:                     "pw",
+		NoTLS:                        true,
+		TLSConfig:                    fs.client,
+		InsecureAllowUnencryptedAuth: true,
+	}
+}
+
+func (fs *fakeServer) serve() {
+	conn, err := fs.ln.Accept()
+	if err != nil {
+		return
+	}
+	fc := &fakeConn{Conn: conn, d: xml.NewDecoder(conn)}
+	defer func() { fc.Close() }()
+
+	encrypted, authed := false, false
+	for {
+		se, inner, err := fc.next()
+		if err != nil {
+			return
+		}
+		switch {
+		case se.Name.Local == "stream":
+			fc.send("<?xml version='1.0'?><stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' id='s1' from='example.com' version='1.0'><stream:features>")
+			switch {
+			case encrypted || fs.starttls == "":
+			case fs.starttls == "required":
+				fc.send("<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'><required/></starttls>")
+			default:
+				fc.send("<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>")
+			}
+			if authed {
+				fc.send("<bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/>")
+				if fs.sm {
+					fc.send("<sm xmlns='urn:xmpp:sm:3'/>")
+				}
+			} else {
+				fc.send("<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms>")
+			}
+			fc.send("</stream:features>")
+		case se.Name.Local == "starttls":
+			if fs.starttls == "refused" {
+				fc.send("<failure xmlns='urn:ietf:params:xml:ns:xmpp-tls'/></stream:stream>")
+				return
+			}
+			fc.send("<proceed xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>")
+			tc := tls.Server(fc.Conn, fs.tls)
+			if tc.Handshake() != nil {
+				return
+			}
+			fc.Conn, fc.d = tc, xml.NewDecoder(tc)
+			encrypted = true
+		case se.Name.Local == "auth":
+			fc.send("<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>")
+			fc.d = xml.NewDecoder(fc.Conn)
+			authed = true
+		case se.Name.Local == "iq" && xmlAttr(se, "type") == "set" && isBind(inner):
+			fc.send("<iq type='result' id='" + xmlAttr(se, "id") + "'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>user@example.com/res</jid></bind></iq>")
+		case se.Name.Local == "enable":
+			fc.send("<enabled xmlns='urn:xmpp:sm:3'/>")
+		case se.Name.Space == nsSM:
+			// Requests for acknowledgement go unanswered.
+		case fs.stanza != nil:
+			fs.stanza(fc, se, inner)
+		}
+	}
+}
+
+// isBind reports whether inner, the payload of an IQ, is a resource binding
+// request.
+func isBind(inner string) bool {
+	var v struct {
+		XMLName xml.Name
+	}
+	return xml.Unmarshal([]byte(inner), &v) == nil && v.XMLName.Space == nsBind
+}
+
+func xmlAttr(se xml.StartElement, name string) string {
+	for _, a := range se.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// testTLS returns the configurations of a server with a self-signed
+// certificate for example.com, and of a client that trusts it.
+func testTLS(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: pool, ServerName: "example.com"}
+	return server, client
+}
+
+func TestStartTLSSkipped(t *testing.T) {
+	fs := newFakeServer(t, "offered")
+	c, err := fs.options().NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.IsEncrypted() {
+		t.Error("STARTTLS negotiated, but neither side asked for it")
+	}
+}
+
+func TestStartTLSRequired(t *testing.T) {
+	fs := newFakeServer(t, "required")
+	o := fs.options()
+	o.TLSPolicy = TLSDisabled
+	_, err := o.NewClient()
+	if !errors.Is(err, ErrStartTLSRequired) {
+		t.Fatalf("got %v, want %v", err, ErrStartTLSRequired)
+	}
+}
+
+func TestStartTLSUnavailable(t *testing.T) {
+	fs := newFakeServer(t, "")
+	o := fs.options()
+	o.TLSPolicy = RequireTLS
+	_, err := o.NewClient()
+	if !errors.Is(err, ErrStartTLSUnavailable) {
+		t.Fatalf("got %v, want %v", err, ErrStartTLSUnavailable)
+	}
+}
+
+func TestStartTLSFailed(t *testing.T) {
+	fs := newFakeServer(t, "refused")
+	o := fs.options()
+	o.StartTLS = true
+	_, err := o.NewClient()
+	if !errors.Is(err, ErrStartTLSFailed) {
+		t.Fatalf("got %v, want %v", err, ErrStartTLSFailed)
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	fs := newFakeServer(t, "offered")
+	o := fs.options()
+	o.StartTLS = true
+	o.InsecureAllowUnencryptedAuth = false
+	c, err := o.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.IsEncrypted() {
+		t.Error("STARTTLS not negotiated")
+	}
+}
+
+func TestStartTLSHandshakeError(t *testing.T) {
+	fs := newFakeServer(t, "required")
+	o := fs.options()
+	o.TLSConfig = &tls.Config{ServerName: "example.com"} // does not trust the certificate
+	_, err := o.NewClient()
+	var uae x509.UnknownAuthorityError
+	if !errors.As(err, &uae) {
+		t.Fatalf("got %v, want an x509.UnknownAuthorityError", err)
+	}
+}
+
+// redirect makes fs answer a presence that contains status with a
+// see-other-host stream error naming addr.
+func (fs *fakeServer) redirect(status, addr string) {
+	fs.stanza = func(fc *fakeConn, se xml.StartElement, inner string) {
+		if se.Name.Local == "presence" && strings.Contains(inner, status) {
+			fc.send("<stream:error><see-other-host xmlns='urn:ietf:params:xml:ns:xmpp-streams'>" + addr + "</see-other-host></stream:error>")
+		}
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	to := newFakeServer(t, "")
+	sent := make(chan string, 3)
+	to.stanza = func(fc *fakeConn, se xml.StartElement, inner string) {
+		if se.Name.Local == "presence" {
+			sent <- xmlAttr(se, "to") + " " + inner
+		}
+	}
+	fs := newFakeServer(t, "")
+	fs.redirect("busy", to.ln.Addr().String())
+
+	c, err := fs.options().NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.JoinMUC("room@conference.example.com/me")
+	c.SendPresence(Presence{Show: "dnd", Status: "busy"})
+	go c.Recv()
+
+	// The initial presence, then the last one sent and the room joined.
+	want := []string{
+		" ",
+		" <show>dnd</show><status>busy</status>",
+		`room@conference.example.com/me <x xmlns="http://jabber.org/protocol/muc"><history maxstanzas="0"></history></x>`,
+	}
+	for _, w := range want {
+		select {
+		case s := <-sent:
+			if s != w {
+				t.Errorf("got presence %q, want %q", s, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("presence %q not sent after redirect", w)
+		}
+	}
+}
+
+func TestRedirectUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	fs := newFakeServer(t, "")
+	fs.redirect("", ln.Addr().String())
+
+	o := fs.options()
+	o.KeepAliveInterval = time.Millisecond
+	c, err := o.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Recv(); err == nil {
+		t.Fatal("Recv succeeded after a redirect to a closed port")
+	}
+	// The client keeps its old connection, for keepalives and Close.
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+}
+
+// echo makes fs send messages and presences back to the client, and answer
+// IQs with an empty result.
+func (fs *fakeServer) echo() {
+	fs.stanza = func(fc *fakeConn, se xml.StartElement, inner string) {
+		switch name := se.Name.Local; name {
+		case "message", "presence":
+			fc.send("<" + name + " from='peer@example.com/res'>" + inner + "</" + name + ">")
+		case "iq":
+			fc.send("<iq type='result' id='" + xmlAttr(se, "id") + "' from='" + xmlAttr(se, "to") + "'/>")
+		}
+	}
+}
+
+// TestConcurrentUse sends from many goroutines while Recv runs, for the race
+// detector, and checks that every stanza comes back whole.
+func TestConcurrentUse(t *testing.T) {
+	fs := newFakeServer(t, "")
+	fs.echo()
+	c, err := fs.options().NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	const n = 20
+	events := make(chan interface{}, 3*n)
+	go func() {
+		for {
+			v, err := c.Recv()
+			if err != nil {
+				close(events)
+				return
+			}
+			events <- v
+		}
+	}()
+	for atomic.LoadInt32(&c.reading) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := c.Recv(); err != ErrConcurrentRecv {
+		t.Errorf("second Recv: got %v, want %v", err, ErrConcurrentRecv)
+	}
+	if err := c.Serve(context.Background(), NewMux()); err != ErrConcurrentRecv {
+		t.Errorf("Serve during Recv: got %v, want %v", err, ErrConcurrentRecv)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := c.Send(Chat{Remote: "peer@example.com", Type: "chat", Text: fmt.Sprint("message ", i)}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := c.SendPresence(Presence{To: "peer@example.com", Status: fmt.Sprint("presence ", i)}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			iq, err := c.SendIQ(ctx, IQ{Type: "get", To: "example.com", Payload: "<query xmlns='jabber:iq:version'/>"})
+			if err != nil || iq.Type != "result" {
+				t.Errorf("SendIQ: got %v, %v", iq, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	timeout := time.After(5 * time.Second)
+	for len(seen) < 2*n {
+		select {
+		case v, ok := <-events:
+			if !ok {
+				t.Fatal("Recv failed")
+			}
+			switch v := v.(type) {
+			case Chat:
+				seen[v.Text] = true
+			case Presence:
+				if v.Status != "" {
+					seen[v.Status] = true
+				}
+			}
+		case <-timeout:
+			t.Fatalf("got back %d of %d stanzas", len(seen), 2*n)
+		}
+	}
+}
+
+func TestCloseDuringWrite(t *testing.T) {
+	fs := newFakeServer(t, "")
+	c, err := fs.options().NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pretend a write is stuck on the connection.
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	closed := make(chan error, 1)
+	go func() { closed <- c.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for a write")
+	}
+}
+
+// pingServer returns a fakeServer that pings the client once it is available
+// and reports the type of the answer.
+func pingServer(t *testing.T) (*fakeServer, chan string) {
+	fs := newFakeServer(t, "")
+	answers := make(chan string, 1)
+	fs.stanza = func(fc *fakeConn, se xml.StartElement, inner string) {
+		switch se.Name.Local {
+		case "presence":
+			fc.send("<iq type='get' id='ping1' from='example.com'><ping xmlns='urn:xmpp:ping'/></iq>")
+		case "iq":
+			if xmlAttr(se, "id") == "ping1" {
+				answers <- xmlAttr(se, "type")
+			}
+		}
+	}
+	return fs, answers
+}
+
+func TestPingAnswered(t *testing.T) {
+	for _, serve := range []bool{false, true} {
+		fs, answers := pingServer(t)
+		c, err := fs.options().NewClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serve {
+			go c.Serve(context.Background(), NewMux())
+		} else {
+			go c.Recv()
+		}
+		select {
+		case typ := <-answers:
+			if typ != "result" {
+				t.Errorf("serve=%v: ping answered with %q", serve, typ)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("serve=%v: ping not answered", serve)
+		}
+		c.Close()
+	}
+}
+
+func TestPingHandler(t *testing.T) {
+	fs, answers := pingServer(t)
+	c, err := fs.options().NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	mux := NewMux()
+	mux.HandleIQ("get", nsPing, func(c *Client, iq IQ) {
+		c.SendIQError(iq, &StanzaError{Type: "cancel", Condition: CondFeatureNotImplemented})
+	})
+	go c.Serve(context.Background(), mux)
+	select {
+	case typ := <-answers:
+		if typ != "error" {
+			t.Errorf("ping answered with %q, not by the handler", typ)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("ping not answered")
+	}
+}
+
+func TestReconnectClose(t *testing.T) {
+	// With a long backoff Close interrupts the wait; with a short one it
+	// interrupts the login to fs, which accepts a single connection.
+	for _, backoff := range []time.Duration{time.Hour, time.Millisecond} {
+		fs := newFakeServer(t, "")
+		fs.stanza = func(fc *fakeConn, se xml.StartElement, inner string) {
+			fc.Close()
+		}
+		r, err := fs.options().NewReconnectingClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.MinBackoff = backoff
+		disconnected := make(chan bool)
+		r.OnDisconnect = func(error) { close(disconnected) }
+		errc := make(chan error, 1)
+		go func() {
+			_, err := r.Recv()
+			errc <- err
+		}()
+		r.Client().Send(Chat{Remote: "peer@example.com", Text: "bye"})
+		<-disconnected
+		time.Sleep(10 * time.Millisecond)
+		r.Close()
+		select {
+		case err := <-errc:
+			if err != ErrClientClosed {
+				t.Errorf("backoff %v: Recv after Close returned %v, want %v", backoff, err, ErrClientClosed)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("backoff %v: Close did not stop reconnecting", backoff)
+		}
+	}
+}
+
+func TestReconnectResendsAfterRestore(t *testing.T) {
+	fs := newFakeServer(t, "")
+	fs.sm = true
+	var (
+		mu    sync.Mutex
+		conns []*fakeConn
+		got   = make(chan string, 16)
+	)
+	fs.stanza = func(fc *fakeConn, se xml.StartElement, inner string) {
+		mu.Lock()
+		if len(conns) == 0 || conns[len(conns)-1] != fc {
+			conns = append(conns, fc)
+		}
+		first := len(conns) == 1
+		mu.Unlock()
+		s := se.Name.Local + " to=" + xmlAttr(se, "to") + " type=" + xmlAttr(se, "type")
+		if strings.Contains(inner, "<show>") {
+			s += " show"
+		}
+		if !first {
+			got <- s
+		} else if xmlAttr(se, "type") == "subscribe" {
+			// The server acknowledged nothing: the client must send it all again.
+			go fs.serve()
+			fc.Close()
+		}
+	}
+
+	o := fs.options()
+	o.StreamManagement = true
+	r, err := o.NewReconnectingClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.MinBackoff = time.Millisecond
+	go r.Recv()
+
+	c := r.Client()
+	c.JoinMUC("room@muc.example.com/me")
+	c.SendPresence(Presence{Show: "away"})
+	c.Send(Chat{Remote: "peer@example.com", Type: "chat", Text: "lost"})
+	c.SendPresence(Presence{To: "peer@example.com", Type: "subscribe"})
+
+	want := []string{
+		"presence to= type=",                        // sent on login
+		"presence to= type= show",                   // restored
+		"presence to=room@muc.example.com/me type=", // joined again
+		"message to=peer@example.com type=chat",
+		"presence to=peer@example.com type=subscribe",
+	}
+	for _, w := range want {
+		select {
+		case s := <-got:
+			if s != w {
+				t.Errorf("got %q, want %q", s, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q not sent after reconnecting", w)
+		}
+	}
+	select {
+	case s := <-got:
+		t.Errorf("also got %q", s)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
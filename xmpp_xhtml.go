@@ -0,0 +1,409 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	"unicode"
+)
+
+const (
+	nsXHTMLIM = "http://jabber.org/protocol/xhtml-im"
+	nsXHTML   = "http://www.w3.org/1999/xhtml"
+)
+
+// XHTML is the sanitized XHTML-IM (XEP-0071) body of a message.  It holds
+// only the elements, attributes and style properties of the recommended
+// profile of XEP-0071 7, and links and images with safe URIs, so it can be
+// rendered as HTML as is.
+type XHTML struct {
+	Lang  string      // xml:lang of the body, if given
+	Nodes []XHTMLNode // content of the body
+}
+
+// XHTMLNode is an element or a run of text in an XHTML body.
+type XHTMLNode struct {
+	Name     string     // element name, such as "p" or "a"; empty for text
+	Attr     []xml.Attr // attributes of the element, such as href or style
+	Text     string     // the text, if Name is empty
+	Children []XHTMLNode
+}
+
+// xhtmlAttrs lists the elements of the recommended profile and the
+// attributes each may carry.
+var xhtmlAttrs = map[string][]string{
+	"a":          {"href", "style", "type"},
+	"blockquote": {"style"},
+	"br":         nil,
+	"cite":       {"style"},
+	"em":         nil,
+	"img":        {"alt", "height", "src", "style", "width"},
+	"li":         {"style"},
+	"ol":         {"style"},
+	"p":          {"style"},
+	"span":       {"style"},
+	"strong":     nil,
+	"ul":         {"style"},
+}
+
+// xhtmlAliases maps presentational elements to their equivalent in the
+// recommended profile.
+var xhtmlAliases = map[string]string{"b": "strong", "i": "em"}
+
+// xhtmlDropped lists elements whose content must not be shown either.
+var xhtmlDropped = map[string]bool{
+	"applet": true, "embed": true, "frame": true, "frameset": true, "head": true, "iframe": true,
+	"noscript": true, "object": true, "script": true, "style": true, "template": true, "title": true,
+}
+
+// xhtmlStyles lists the CSS properties of the recommended profile.
+var xhtmlStyles = map[string]bool{
+	"background-color": true, "color": true, "font-family": true, "font-size": true, "font-style": true,
+	"font-weight": true, "margin-left": true, "margin-right": true, "text-align": true, "text-decoration": true,
+}
+
+// ParseXHTML parses html and sanitizes it.  Elements outside the recommended
+// profile are replaced by their content, except for those such as <script/>
+// whose content is dropped as well.
+//
+// html must be XHTML, though with some of the leniency of HTML: names may be
+// in upper case, void elements such as <br> need no end tag, elements still
+// open at the end are closed, and HTML entities such as &nbsp; are known.
+// Other HTML is not: a bare < or an unquoted attribute value is an error, and
+// a <p> or <li> is not ended by the next one but contains it.
+func ParseXHTML(html string) (*XHTML, error) {
+	d := xml.NewDecoder(strings.NewReader("<body>" + html + "</body>"))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	if _, err := d.Token(); err != nil {
+		return nil, err
+	}
+	nodes, err := xhtmlNodes(d)
+	if err != nil {
+		return nil, errors.New("xmpp: invalid HTML: " + err.Error())
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, errors.New("xmpp: invalid HTML: unbalanced elements")
+	}
+	return &XHTML{Nodes: nodes}, nil
+}
+
+// xhtmlNodes reads sanitized nodes from d up to the end of the enclosing
+// element.
+func xhtmlNodes(d *xml.Decoder) ([]XHTMLNode, error) {
+	var nodes []XHTMLNode
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return nodes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			if t.Name.Space != "" && t.Name.Space != nsXHTML {
+				name = ""
+			}
+			if alias, ok := xhtmlAliases[name]; ok {
+				name = alias
+			}
+			if xhtmlDropped[name] {
+				if err := d.Skip(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			children, err := xhtmlNodes(d)
+			if err != nil {
+				return nil, err
+			}
+			allowed, ok := xhtmlAttrs[name]
+			if !ok {
+				for _, c := range children {
+					nodes = appendNode(nodes, c)
+				}
+				continue
+			}
+			n := XHTMLNode{Name: name, Children: children}
+			for _, a := range t.Attr {
+				if v, ok := xhtmlAttr(strings.ToLower(a.Name.Local), a.Value, allowed); a.Name.Space == "" && ok {
+					n.Attr = append(n.Attr, xml.Attr{Name: xml.Name{Local: strings.ToLower(a.Name.Local)}, Value: v})
+				}
+			}
+			if name == "br" || name == "img" {
+				n.Children = nil
+			}
+			nodes = append(nodes, n)
+		case xml.CharData:
+			nodes = appendNode(nodes, XHTMLNode{Text: string(t)})
+		case xml.EndElement:
+			return nodes, nil
+		}
+	}
+}
+
+// appendNode appends n to nodes, merging runs of text.
+func appendNode(nodes []XHTMLNode, n XHTMLNode) []XHTMLNode {
+	if k := len(nodes) - 1; n.Name == "" && k >= 0 && nodes[k].Name == "" {
+		nodes[k].Text += n.Text
+		return nodes
+	}
+	return append(nodes, n)
+}
+
+// xhtmlAttr returns the sanitized value of the attribute name, and whether
+// to keep it, given the attributes allowed on the element.
+func xhtmlAttr(name, value string, allowed []string) (string, bool) {
+	ok := false
+	for _, a := range allowed {
+		ok = ok || a == name
+	}
+	if !ok {
+		return "", false
+	}
+	switch name {
+	case "href":
+		return value, safeURI(value, "http", "https", "mailto", "xmpp")
+	case "src":
+		return value, safeURI(value, "http", "https", "cid")
+	case "style":
+		v := sanitizeStyle(value)
+		return v, v != ""
+	}
+	return value, true
+}
+
+// safeURI reports whether uri has one of the given schemes.
+func safeURI(uri string, schemes ...string) bool {
+	i := strings.IndexByte(uri, ':')
+	if i < 0 {
+		return false
+	}
+	scheme := strings.ToLower(strings.TrimSpace(uri[:i]))
+	for _, s := range schemes {
+		if scheme == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeStyle keeps the declarations of style that set a property of the
+// recommended profile to a harmless value.
+func sanitizeStyle(style string) string {
+	var kept []string
+	for _, decl := range strings.Split(style, ";") {
+		i := strings.IndexByte(decl, ':')
+		if i < 0 {
+			continue
+		}
+		prop := strings.ToLower(strings.TrimSpace(decl[:i]))
+		value := strings.TrimSpace(decl[i+1:])
+		lower := strings.ToLower(value)
+		if !xhtmlStyles[prop] || value == "" || strings.ContainsAny(value, "\\/*<>&{}@") ||
+			strings.Contains(lower, "url") || strings.Contains(lower, "expression") {
+			continue
+		}
+		kept = append(kept, prop+": "+value)
+	}
+	return strings.Join(kept, "; ")
+}
+
+// parseXHTMLIM returns the sanitized body of e, an XHTML-IM <html/> element,
+// in language lang, or else the first one, or nil.
+func parseXHTMLIM(e RawElement, lang string) *XHTML {
+	var w strings.Builder
+	if err := xml.NewEncoder(&w).Encode(e); err != nil {
+		return nil
+	}
+	d := xml.NewDecoder(strings.NewReader(w.String()))
+	if _, err := d.Token(); err != nil {
+		return nil
+	}
+	var first *XHTML
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return first
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if se.Name.Space != nsXHTML || se.Name.Local != "body" {
+			d.Skip()
+			continue
+		}
+		x := &XHTML{}
+		for _, a := range se.Attr {
+			if a.Name.Space == nsXML && a.Name.Local == "lang" {
+				x.Lang = a.Value
+			}
+		}
+		if x.Nodes, err = xhtmlNodes(d); err != nil {
+			return first
+		}
+		if x.Lang == "" || x.Lang == lang {
+			return x
+		}
+		if first == nil {
+			first = x
+		}
+	}
+}
+
+// MarshalXML encodes x as an XHTML-IM <html/> element.
+func (x XHTML) MarshalXML(enc *xml.Encoder, _ xml.StartElement) error {
+	html := xml.StartElement{Name: xml.Name{Space: nsXHTMLIM, Local: "html"}}
+	body := xml.StartElement{Name: xml.Name{Space: nsXHTML, Local: "body"}}
+	if x.Lang != "" {
+		body.Attr = []xml.Attr{{Name: xml.Name{Space: nsXML, Local: "lang"}, Value: x.Lang}}
+	}
+	for _, t := range []xml.StartElement{html, body} {
+		if err := enc.EncodeToken(t); err != nil {
+			return err
+		}
+	}
+	if err := encodeXHTML(enc, x.Nodes); err != nil {
+		return err
+	}
+	for _, t := range []xml.EndElement{body.End(), html.End()} {
+		if err := enc.EncodeToken(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeXHTML(enc *xml.Encoder, nodes []XHTMLNode) error {
+	for _, n := range nodes {
+		if n.Name == "" {
+			if err := enc.EncodeToken(xml.CharData(n.Text)); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, ok := xhtmlAttrs[n.Name]; !ok {
+			// Not built by ParseXHTML; keep the content only.
+			if err := encodeXHTML(enc, n.Children); err != nil {
+				return err
+			}
+			continue
+		}
+		start := xml.StartElement{Name: xml.Name{Local: n.Name}}
+		for _, a := range n.Attr {
+			if v, ok := xhtmlAttr(a.Name.Local, a.Value, xhtmlAttrs[n.Name]); ok {
+				start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: a.Name.Local}, Value: v})
+			}
+		}
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+		if err := encodeXHTML(enc, n.Children); err != nil {
+			return err
+		}
+		if err := enc.EncodeToken(start.End()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String returns the sanitized body as XHTML markup, without the enclosing
+// <body/>, for rendering.
+func (x *XHTML) String() string {
+	var w strings.Builder
+	enc := xml.NewEncoder(&w)
+	if encodeXHTML(enc, x.Nodes) != nil || enc.Flush() != nil {
+		return ""
+	}
+	// HTML reads </br> as another line break.  The encoder escapes '>' in
+	// attribute values, so this only matches end tags.
+	s := strings.Replace(w.String(), "<br></br>", "<br/>", -1)
+	return strings.Replace(s, "></img>", "/>", -1)
+}
+
+// Text returns the body as plain text, as a fallback for clients that do not
+// render XHTML: blocks and line breaks become single new lines, list items start with a
+// dash, link targets follow the link text and images are replaced by their
+// alternative text.
+func (x *XHTML) Text() string {
+	var w strings.Builder
+	xhtmlText(&w, x.Nodes)
+	var lines []string
+	for _, l := range strings.Split(w.String(), "\n") {
+		if l = strings.Join(strings.Fields(l), " "); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func xhtmlText(w *strings.Builder, nodes []XHTMLNode) {
+	for _, n := range nodes {
+		switch n.Name {
+		case "":
+			// New lines in the text are mere spaces; Text collapses them.
+			w.WriteString(strings.Map(func(r rune) rune {
+				if unicode.IsSpace(r) {
+					return ' '
+				}
+				return r
+			}, n.Text))
+		case "br":
+			w.WriteString("\n")
+		case "img":
+			w.WriteString(attrValue(n.Attr, "alt"))
+		case "li":
+			w.WriteString("\n- ")
+			xhtmlText(w, n.Children)
+			w.WriteString("\n")
+		case "p", "blockquote", "ol", "ul":
+			w.WriteString("\n")
+			xhtmlText(w, n.Children)
+			w.WriteString("\n")
+		case "a":
+			var inner strings.Builder
+			xhtmlText(&inner, n.Children)
+			text, href := strings.TrimSpace(inner.String()), attrValue(n.Attr, "href")
+			w.WriteString(text)
+			if href != "" && href != text && strings.TrimPrefix(href, "mailto:") != text {
+				w.WriteString(" <" + href + ">")
+			}
+		default:
+			xhtmlText(w, n.Children)
+		}
+	}
+}
+
+func attrValue(attr []xml.Attr, name string) string {
+	for _, a := range attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// SendXHTML sends chat with html as its XHTML-IM body, sanitized by
+// ParseXHTML.  Unless chat has a body already, the plain text of html is sent
+// as the body for clients that do not render XHTML.
+func (c *Client) SendXHTML(chat Chat, html string) (n int, err error) {
+	x, err := ParseXHTML(html)
+	if err != nil {
+		return 0, err
+	}
+	chat.HTML = x
+	if chat.Text == "" && len(chat.Bodies) == 0 {
+		chat.Text = x.Text()
+	}
+	return c.Send(chat)
+}
@@ -0,0 +1,165 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestParseXHTML(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"<p>Hello, <strong>world</strong>!</p>", "<p>Hello, <strong>world</strong>!</p>"},
+		{"<B>bold</B> <i>em</i>", "<strong>bold</strong> <em>em</em>"},
+		{"one<br>two<BR/>three", "one<br/>two<br/>three"},
+		{"x &nbsp;&lt;&amp;", "x \u00a0&lt;&amp;"},
+		{"<p>open", "<p>open</p>"},
+
+		// Links and images keep safe URIs only.
+		{`<a href="https://example.com/">x</a>`, `<a href="https://example.com/">x</a>`},
+		{`<a href="xmpp:juliet@example.com">x</a>`, `<a href="xmpp:juliet@example.com">x</a>`},
+		{`<a href="javascript:alert(1)">x</a>`, `<a>x</a>`},
+		{`<a href=" JavaScript:alert(1)">x</a>`, `<a>x</a>`},
+		{`<a href="data:text/html,x">x</a>`, `<a>x</a>`},
+		{`<a href="//evil.example/">x</a>`, `<a>x</a>`},
+		{`<a href="evil.html">x</a>`, `<a>x</a>`},
+		{`<img src="javascript:x" alt="y">`, `<img alt="y"/>`},
+		{`<img src="cid:part1@example.com" alt="y">`, `<img src="cid:part1@example.com" alt="y"/>`},
+
+		// Event handlers and other attributes are dropped.
+		{`<p onclick="x()" ONMOUSEOVER="y()" class="c" id="i">t</p>`, `<p>t</p>`},
+		{`<img src="https://example.com/a.png" onerror="x()">`, `<img src="https://example.com/a.png"/>`},
+
+		// Styles keep the properties of the profile with harmless values.
+		{`<span style="color: red; position: fixed">t</span>`, `<span style="color: red">t</span>`},
+		{`<span style="background-color: url(https://evil.example/)">t</span>`, `<span>t</span>`},
+		{`<span style="color: expression(alert(1))">t</span>`, `<span>t</span>`},
+		{`<span style="color: EXPRESSION(alert(1)); font-weight: bold">t</span>`, `<span style="font-weight: bold">t</span>`},
+		{`<span style="font-family: \75rl(x)">t</span>`, `<span>t</span>`},
+		{`<span style="color:red;color:/*x*/blue">t</span>`, `<span style="color: red">t</span>`},
+
+		// Unknown elements are replaced by their content, scripts and the
+		// like dropped with it.
+		{"<div><font>a</font><u>b</u></div>", "ab"},
+		{"a<script>alert(1)</script>b", "ab"},
+		{"a<style>p { color: red }</style>b", "ab"},
+		{"a<iframe src='https://evil.example/'>c</iframe>b", "ab"},
+		{"<svg:svg xmlns:svg='http://www.w3.org/2000/svg'><svg:p>a</svg:p></svg:svg>", "a"},
+	}
+	for _, tt := range tests {
+		x, err := ParseXHTML(tt.in)
+		if err != nil {
+			t.Errorf("ParseXHTML(%q): %v", tt.in, err)
+			continue
+		}
+		if got := x.String(); got != tt.out {
+			t.Errorf("ParseXHTML(%q) = %q, want %q", tt.in, got, tt.out)
+		}
+	}
+}
+
+func TestParseXHTMLInvalid(t *testing.T) {
+	for _, s := range []string{
+		"a < b",
+		"<a href=https://example.com/>x</a>",
+		"<p>a</b>",
+		"</p>",
+		// The content cannot end the <body/> it is wrapped in.
+		"</body><script>alert(1)</script>",
+		"x</body><body>y",
+		"<script>x</body><p>y</p>",
+	} {
+		if x, err := ParseXHTML(s); err == nil {
+			t.Errorf("ParseXHTML(%q) = %q, want an error", s, x)
+		}
+	}
+}
+
+func TestXHTMLText(t *testing.T) {
+	tests := []struct {
+		in, text string
+	}{
+		{"Hello, <strong>world</strong>!", "Hello, world!"},
+		{"<p>one\n  two</p><p>three</p>", "one two\nthree"},
+		{"a<br/>b", "a\nb"},
+		{"<ul><li>one</li><li>two</li></ul>", "- one\n- two"},
+		{`see <a href="https://example.com/">this</a>`, "see this <https://example.com/>"},
+		{`<a href="https://example.com/">https://example.com/</a>`, "https://example.com/"},
+		{`<a href="mailto:juliet@example.com">juliet@example.com</a>`, "juliet@example.com"},
+		{`<a href="javascript:x">this</a>`, "this"},
+		{`an <img src="https://example.com/a.png" alt="image"/>`, "an image"},
+		{"a &lt;b&gt;", "a <b>"},
+	}
+	for _, tt := range tests {
+		x, err := ParseXHTML(tt.in)
+		if err != nil {
+			t.Errorf("ParseXHTML(%q): %v", tt.in, err)
+			continue
+		}
+		if got := x.Text(); got != tt.text {
+			t.Errorf("ParseXHTML(%q).Text() = %q, want %q", tt.in, got, tt.text)
+		}
+	}
+}
+
+func TestXHTMLInbound(t *testing.T) {
+	tests := []struct {
+		message string
+		lang    string // of the body chosen
+		html    string
+	}{
+		{
+			message: `<message xmlns='jabber:client' xml:lang='en'><body>hi</body>` +
+				`<html xmlns='http://jabber.org/protocol/xhtml-im'><body xmlns='http://www.w3.org/1999/xhtml'>` +
+				`<p style='color: red; behavior: url(x.htc)' onclick='x()'>hi<script>x()</script></p>` +
+				`</body></html></message>`,
+			html: `<p style="color: red">hi</p>`,
+		},
+		{
+			message: `<message xmlns='jabber:client' xml:lang='fr'>` +
+				`<html xmlns='http://jabber.org/protocol/xhtml-im'>` +
+				`<body xmlns='http://www.w3.org/1999/xhtml' xml:lang='en'>hello</body>` +
+				`<body xmlns='http://www.w3.org/1999/xhtml' xml:lang='fr'>bonjour</body>` +
+				`</html></message>`,
+			lang: "fr",
+			html: "bonjour",
+		},
+		{
+			// No body in the language of the message: the first one.
+			message: `<message xmlns='jabber:client' xml:lang='de'>` +
+				`<html xmlns='http://jabber.org/protocol/xhtml-im'>` +
+				`<body xmlns='http://www.w3.org/1999/xhtml' xml:lang='en'>hello</body>` +
+				`<body xmlns='http://www.w3.org/1999/xhtml' xml:lang='fr'>bonjour</body>` +
+				`</html></message>`,
+			lang: "en",
+			html: "hello",
+		},
+		{
+			// A body without xml:lang is in the language of the message.
+			message: `<message xmlns='jabber:client' xml:lang='fr'>` +
+				`<html xmlns='http://jabber.org/protocol/xhtml-im'>` +
+				`<body xmlns='http://www.w3.org/1999/xhtml' xml:lang='en'>hello</body>` +
+				`<body xmlns='http://www.w3.org/1999/xhtml'><a href='javascript:x()'>bonjour</a></body>` +
+				`</html></message>`,
+			html: "<a>bonjour</a>",
+		},
+	}
+	for _, tt := range tests {
+		var m clientMessage
+		if err := xml.Unmarshal([]byte(tt.message), &m); err != nil {
+			t.Fatal(err)
+		}
+		chat := m.chat()
+		if chat.HTML == nil {
+			t.Errorf("%s: no XHTML body", tt.message)
+			continue
+		}
+		if chat.HTML.Lang != tt.lang || chat.HTML.String() != tt.html {
+			t.Errorf("%s: got %q in %q, want %q in %q", tt.message, chat.HTML, chat.HTML.Lang, tt.html, tt.lang)
+		}
+	}
+}